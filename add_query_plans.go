@@ -4,11 +4,19 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"time"
 )
 
 type QueryWithPlan struct {
-	Query string
-	Plan  string
+	Query       string
+	Fingerprint string    `json:",omitempty"`
+	Parameters  []*string `json:",omitempty"`
+	// How long the query took when the tests ran it through the proxy
+	Duration time.Duration `json:",omitempty"`
+	// Command tag and number of rows returned when the tests ran it
+	CommandTag string `json:",omitempty"`
+	Rows       int64  `json:",omitempty"`
+	Plan       string
 }
 
 func AddQueryPlansForChanges(connStr string, queries []Query) []QueryWithPlan {
@@ -22,14 +30,46 @@ func AddQueryPlansForChanges(connStr string, queries []Query) []QueryWithPlan {
 	queryWithPlans := []QueryWithPlan{}
 	for _, query := range queries {
 		// Get the query plan using EXPLAIN ANALYZE
-		var plan string
-		err := db.QueryRow("EXPLAIN ANALYZE " + query.Query).Scan(&plan)
+		// Bind the captured parameter values so placeholders are planned
+		// with the values the tests actually used
+		args := make([]interface{}, len(query.Parameters))
+		for i, p := range query.Parameters {
+			if p != nil {
+				args[i] = *p
+			}
+		}
+		plan, err := explainAnalyze(db, query.Query, args)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to get plan for query: %v\n", err)
 			continue
 		}
 		fmt.Printf("Plan for query: %s\n%s\n", query.Query, plan)
-		queryWithPlans = append(queryWithPlans, QueryWithPlan{Query: query.Query, Plan: plan})
+		queryWithPlans = append(queryWithPlans, QueryWithPlan{
+			Query:       query.Query,
+			Fingerprint: query.Fingerprint,
+			Parameters:  query.Parameters,
+			Duration:    query.Duration,
+			CommandTag:  query.CommandTag,
+			Rows:        query.Rows,
+			Plan:        plan,
+		})
 	}
 	return queryWithPlans
 }
+
+// explainAnalyze returns the plan of query. EXPLAIN ANALYZE runs the query,
+// so it runs in a transaction that is rolled back, as the captured
+// statements include writes that must not be applied again.
+func explainAnalyze(db *sql.DB, query string, args []interface{}) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var plan string
+	if err := tx.QueryRow("EXPLAIN ANALYZE "+query, args...).Scan(&plan); err != nil {
+		return "", err
+	}
+	return plan, nil
+}
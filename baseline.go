@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Where baselines come from
+const (
+	BaselineGitHub = "github"
+	BaselineDir    = "dir"
+	BaselineHTTP   = "http"
+)
+
+// BaselineProvider fetches the baseline files of earlier runs
+type BaselineProvider interface {
+	// Fetch returns the content of the baseline name.json of the run the
+	// selector picks, empty when there is none
+	Fetch(name string, selector baselineSelector) (string, error)
+}
+
+// BaselinePublisher is a provider that recon saves the files of its own
+// run to, so later runs can use them as their baseline
+type BaselinePublisher interface {
+	Publish(name string, data []byte, run baselineSelector) error
+}
+
+// loadBaselineProvider reads BASELINE_PROVIDER and the settings of the
+// provider it names
+func loadBaselineProvider() (BaselineProvider, error) {
+	switch provider := getEnv("BASELINE_PROVIDER", BaselineGitHub); provider {
+	case BaselineGitHub:
+		return githubArtifacts{
+			apiURL: githubAPIURL(),
+			repo:   os.Getenv("GITHUB_REPOSITORY"),
+			token:  os.Getenv("GITHUB_TOKEN"),
+		}, nil
+	case BaselineDir:
+		dir := os.Getenv("BASELINE_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("BASELINE_DIR is required with the %s provider", BaselineDir)
+		}
+		return baselineDir{dir: dir}, nil
+	case BaselineHTTP:
+		return loadBaselineHTTP()
+	default:
+		return nil, fmt.Errorf("unknown BASELINE_PROVIDER %q, expected %s, %s or %s", provider, BaselineGitHub, BaselineDir, BaselineHTTP)
+	}
+}
+
+// baselineSelector picks the run whose files are the baseline, or names
+// the run being published
+type baselineSelector struct {
+	// Run for exactly this commit, when set
+	commit string
+	// Otherwise the newest run on this branch
+	branch string
+	// Whether to fall back to the branch when the commit has no baseline,
+	// for a commit that is the merge-base of a pull request
+	fallback bool
+}
+
+// key returns the path of the file of the selected run within a
+// directory or object store: commits/{sha}/{name}.json, or
+// branches/{branch}/{name}.json for the newest run on a branch
+func (s baselineSelector) key(name string) string {
+	if s.commit != "" {
+		return "commits/" + s.commit + "/" + name + ".json"
+	}
+	return "branches/" + s.branch + "/" + name + ".json"
+}
+
+// keys returns the paths a run is published under, both by commit and as
+// the newest run on its branch
+func (s baselineSelector) keys(name string) []string {
+	var keys []string
+	if s.commit != "" {
+		keys = append(keys, baselineSelector{commit: s.commit}.key(name))
+	}
+	if s.branch != "" {
+		keys = append(keys, baselineSelector{branch: s.branch}.key(name))
+	}
+	return keys
+}
+
+// validRef reports whether a branch or commit is safe to use in a path,
+// which git's own rules for ref names already ensure
+func validRef(ref string) bool {
+	return !strings.Contains(ref, "..") && !strings.HasPrefix(ref, "/") && !strings.Contains(ref, "\\")
+}
+
+func (s baselineSelector) String() string {
+	if s.commit != "" {
+		return "commit " + s.commit
+	}
+	return "branch " + s.branch
+}
+
+// loadBaselineSelector reads BASELINE_COMMIT, BASELINE_MERGE_BASE and
+// BASELINE_BRANCH, in that order of precedence. Without any of them the
+// baseline is the newest run on the repository's default branch.
+func loadBaselineSelector(apiURL, repo, token string) baselineSelector {
+	s := baselineSelector{
+		commit: os.Getenv("BASELINE_COMMIT"),
+		branch: os.Getenv("BASELINE_BRANCH"),
+	}
+	if s.commit == "" && os.Getenv("BASELINE_MERGE_BASE") == "true" {
+		mergeBase, err := pullRequestMergeBase(apiURL, repo, token)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to find the merge-base of the pull request, falling back to a branch: %v\n", err)
+		}
+		s.commit = mergeBase
+		// CI may have skipped the merge-base, or its baseline expired
+		s.fallback = mergeBase != ""
+	}
+	if (s.commit == "" || s.fallback) && s.branch == "" {
+		s.branch = "main"
+		// Outside of GitHub there is no API to ask
+		if repo != "" && token != "" {
+			branch, err := defaultBranch(apiURL, repo, token)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to get the default branch, using main: %v\n", err)
+			} else {
+				s.branch = branch
+			}
+		}
+	}
+	return s
+}
+
+// loadPublishRun reads the commit and branch the files of this run are
+// published under from BASELINE_PUBLISH_COMMIT and BASELINE_PUBLISH_BRANCH,
+// which default to those GitHub Actions runs for
+func loadPublishRun() baselineSelector {
+	return baselineSelector{
+		commit: getEnv("BASELINE_PUBLISH_COMMIT", os.Getenv("GITHUB_SHA")),
+		branch: getEnv("BASELINE_PUBLISH_BRANCH", os.Getenv("GITHUB_REF_NAME")),
+	}
+}
+
+// defaultBranch returns the default branch of repo
+func defaultBranch(apiURL, repo, token string) (string, error) {
+	resp, err := githubRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s", apiURL, repo), token, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var repository struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&repository); err != nil {
+		return "", err
+	}
+	if repository.DefaultBranch == "" {
+		return "", fmt.Errorf("repository has no default branch")
+	}
+	return repository.DefaultBranch, nil
+}
+
+// pullRequestMergeBase returns the commit the pull request the workflow
+// runs for branched from, the best common ancestor of its base and head
+func pullRequestMergeBase(apiURL, repo, token string) (string, error) {
+	eventPath := os.Getenv("GITHUB_EVENT_PATH")
+	if eventPath == "" {
+		return "", fmt.Errorf("GITHUB_EVENT_PATH not set")
+	}
+	data, err := os.ReadFile(eventPath)
+	if err != nil {
+		return "", err
+	}
+	var event struct {
+		PullRequest struct {
+			Base struct {
+				SHA string `json:"sha"`
+			} `json:"base"`
+			Head struct {
+				SHA string `json:"sha"`
+			} `json:"head"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", err
+	}
+	base, head := event.PullRequest.Base.SHA, event.PullRequest.Head.SHA
+	if base == "" || head == "" {
+		return "", fmt.Errorf("not running for a pull request")
+	}
+
+	resp, err := githubRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s/compare/%s...%s", apiURL, repo, base, head), token, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var comparison struct {
+		MergeBaseCommit struct {
+			SHA string `json:"sha"`
+		} `json:"merge_base_commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&comparison); err != nil {
+		return "", err
+	}
+	if comparison.MergeBaseCommit.SHA == "" {
+		return "", fmt.Errorf("comparison has no merge-base commit")
+	}
+	return comparison.MergeBaseCommit.SHA, nil
+}
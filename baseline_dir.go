@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// baselineDir keeps baselines in a local directory, for runs outside of
+// GitHub Actions or on a laptop. Files live at the paths of
+// baselineSelector.key.
+type baselineDir struct {
+	dir string
+}
+
+func (d baselineDir) Fetch(name string, selector baselineSelector) (string, error) {
+	path := filepath.Join(d.dir, filepath.FromSlash(selector.key(name)))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "Selected baseline: %s\n", path)
+	return string(data), nil
+}
+
+func (d baselineDir) Publish(name string, data []byte, run baselineSelector) error {
+	for _, key := range run.keys(name) {
+		path := filepath.Join(d.dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
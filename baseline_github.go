@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// githubArtifacts fetches baselines from the artifacts of GitHub Actions
+// runs. Workflows upload them with actions/upload-artifact, so it can't
+// publish.
+type githubArtifacts struct {
+	apiURL string
+	repo   string
+	token  string
+}
+
+type githubArtifact struct {
+	Name        string `json:"name"`
+	ArchiveURL  string `json:"archive_download_url"`
+	CreatedAt   string `json:"created_at"`
+	Expired     bool   `json:"expired"`
+	WorkflowRun struct {
+		HeadBranch string `json:"head_branch"`
+		HeadSHA    string `json:"head_sha"`
+	} `json:"workflow_run"`
+}
+
+// Fetch extracts name.json from the newest artifact called name of the
+// run the selector picks
+func (g githubArtifacts) Fetch(name string, selector baselineSelector) (string, error) {
+	if g.repo == "" || g.token == "" {
+		return "", fmt.Errorf("GITHUB_REPOSITORY or GITHUB_TOKEN not set")
+	}
+
+	candidates, err := g.listArtifacts(name, selector)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ti, _ := time.Parse(time.RFC3339, candidates[i].CreatedAt)
+		tj, _ := time.Parse(time.RFC3339, candidates[j].CreatedAt)
+		return ti.After(tj)
+	})
+
+	latest := candidates[0]
+	fmt.Fprintf(os.Stderr, "Selected artifact: %s (created at: %s, commit: %s)\n", latest.Name, latest.CreatedAt, latest.WorkflowRun.HeadSHA)
+	return g.extract(latest, name+".json")
+}
+
+// listArtifacts returns the unexpired artifacts called name of the newest
+// runs the selector matches. It follows the pages of artifacts, 100 at a
+// time, as the baseline run may be older than the newest 100, but as they
+// come newest first it stops at the first page with a match, and for a
+// commit at the first match.
+func (g githubArtifacts) listArtifacts(name string, selector baselineSelector) ([]githubArtifact, error) {
+	var candidates []githubArtifact
+	apiURL := fmt.Sprintf("%s/repos/%s/actions/artifacts?per_page=100&name=%s", g.apiURL, g.repo, url.QueryEscape(name))
+	for apiURL != "" {
+		resp, err := githubRequest(http.MethodGet, apiURL, g.token, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list artifacts: %v", err)
+		}
+		var artifactsResp struct {
+			Artifacts []githubArtifact `json:"artifacts"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&artifactsResp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode artifact list: %v", err)
+		}
+
+		for _, a := range artifactsResp.Artifacts {
+			// Expired artifacts can no longer be downloaded
+			if a.Expired || !strings.Contains(strings.ToLower(a.Name), strings.ToLower(name)) {
+				continue
+			}
+			if selector.commit != "" && a.WorkflowRun.HeadSHA == selector.commit {
+				return []githubArtifact{a}, nil
+			}
+			if selector.commit == "" && a.WorkflowRun.HeadBranch == selector.branch {
+				candidates = append(candidates, a)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+		apiURL = nextPageURL(resp)
+	}
+	return candidates, nil
+}
+
+// extract downloads the ZIP archive of an artifact and returns the
+// content of file in it
+func (g githubArtifacts) extract(a githubArtifact, file string) (string, error) {
+	respZip, err := githubRequest(http.MethodGet, a.ArchiveURL, g.token, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to download artifact zip: %v", err)
+	}
+	defer respZip.Body.Close()
+
+	tmpFile, err := os.CreateTemp("", "artifact-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name()) // clean up
+
+	if _, err := io.Copy(tmpFile, respZip.Body); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("failed to save artifact zip: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close temp file: %v", err)
+	}
+
+	zipReader, err := zip.OpenReader(tmpFile.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to open zip archive: %v", err)
+	}
+	defer zipReader.Close()
+
+	for _, f := range zipReader.File {
+		if f.Name != file {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", fmt.Errorf("failed to open %s in zip: %v", file, err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("%s not found in artifact %s", file, a.Name)
+}
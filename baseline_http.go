@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// baselineHTTP keeps baselines in an object store over plain HTTP: GET
+// fetches a file and PUT publishes it, at the paths of
+// baselineSelector.key under the base URL. With AWS credentials, requests
+// are signed for S3 and stores compatible with it, such as MinIO.
+type baselineHTTP struct {
+	// e.g. https://bucket.s3.amazonaws.com/recon
+	baseURL string
+	// Sent as a bearer token when set and not signing for S3
+	token string
+	s3    *s3Credentials
+}
+
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+}
+
+// loadBaselineHTTP reads BASELINE_URL and BASELINE_HTTP_TOKEN, and the
+// standard AWS_* variables for S3
+func loadBaselineHTTP() (baselineHTTP, error) {
+	h := baselineHTTP{
+		baseURL: strings.TrimSuffix(os.Getenv("BASELINE_URL"), "/"),
+		token:   os.Getenv("BASELINE_HTTP_TOKEN"),
+	}
+	if h.baseURL == "" {
+		return h, fmt.Errorf("BASELINE_URL is required with the %s provider", BaselineHTTP)
+	}
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		h.s3 = &s3Credentials{
+			accessKey:    accessKey,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			region:       getEnv("AWS_REGION", getEnv("AWS_DEFAULT_REGION", "us-east-1")),
+		}
+	}
+	return h, nil
+}
+
+func (h baselineHTTP) Fetch(name string, selector baselineSelector) (string, error) {
+	resp, err := h.do(http.MethodGet, selector.key(name), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// A missing object means there is no baseline. S3 answers 403 instead
+	// without permission to list the bucket, which is reported as an error.
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s: %s", selector.key(name), resp.Status, strings.TrimSpace(string(data)))
+	}
+	fmt.Fprintf(os.Stderr, "Selected baseline: %s/%s\n", h.baseURL, selector.key(name))
+	return string(data), nil
+}
+
+func (h baselineHTTP) Publish(name string, data []byte, run baselineSelector) error {
+	for _, key := range run.keys(name) {
+		resp, err := h.do(http.MethodPut, key, data)
+		if err != nil {
+			return err
+		}
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("PUT %s: %s: %s", key, resp.Status, strings.TrimSpace(string(message)))
+		}
+	}
+	return nil
+}
+
+// do sends a request for the object at key, signing it when configured
+func (h baselineHTTP) do(method, key string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.baseURL+"/"+uriEncode(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case h.s3 != nil:
+		h.s3.sign(req, body, time.Now())
+	case h.token != "":
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 for S3 to req, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *s3Credentials) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+		canonicalHeaders += "x-amz-security-token:" + c.sessionToken + "\n"
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes every byte of a path but slashes and the
+// unreserved characters of RFC 3986, as S3 expects in signed paths
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 )
 
 type DatabaseSchema struct {
@@ -245,6 +246,18 @@ func CompareSchema(current, baseline []DatabaseSchema) []TableChanges {
 			}
 		}
 	}
+	// Databases and tables come from maps, so sort them for a report and
+	// output that don't change order between runs
+	sort.Slice(tableChanges, func(i, j int) bool {
+		a, b := tableChanges[i], tableChanges[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		if a.Schema != b.Schema {
+			return a.Schema < b.Schema
+		}
+		return a.Table < b.Table
+	})
 	return tableChanges
 }
 
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/droptableifexists/recon/sql-proxy/store"
+)
+
+// GetExecutedQueries returns the JSON list of queries captured by the
+// proxy, only those of the given capture session if one is set. When the
+// API can't be reached it falls back to the capture file the proxy
+// persisted, if one is configured.
+func GetExecutedQueries(apiAddress, session string) (string, error) {
+	body, apiErr := getQueriesFromAPI(apiAddress, session)
+	if apiErr == nil {
+		return body, nil
+	}
+
+	captureFile := os.Getenv("SQL_PROXY_CAPTURE_FILE")
+	if captureFile == "" {
+		return "", apiErr
+	}
+	fmt.Fprintf(os.Stderr, "Warning: Failed to call proxy API, reading %s instead: %v\n", captureFile, apiErr)
+	if session != "" {
+		fmt.Fprintf(os.Stderr, "Warning: Capture file holds every query, not only session %s\n", session)
+	}
+
+	var queries []store.QueryExecuted
+	var err error
+	switch backend := os.Getenv("SQL_PROXY_CAPTURE_BACKEND"); backend {
+	case "", store.BackendNDJSON:
+		queries, err = store.ReadNDJSONFile(captureFile)
+	case store.BackendBolt:
+		queries, err = store.ReadBoltFile(captureFile)
+	default:
+		return "", fmt.Errorf("unknown capture backend %q", backend)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read capture file: %v", err)
+	}
+
+	data, err := json.Marshal(queries)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Number of queries requested per page from the proxy API
+const queriesPageSize = 1000
+
+// getQueriesFromAPI pages through the proxy API, following the
+// X-Next-Cursor header until the last page
+func getQueriesFromAPI(apiAddress, session string) (string, error) {
+	path := "/queries"
+	if session != "" {
+		path = "/sessions/" + url.PathEscape(session) + "/queries"
+	}
+	fmt.Println("Calling proxy API on address", apiAddress)
+
+	queries := []json.RawMessage{}
+	cursor := ""
+	for {
+		params := url.Values{}
+		params.Set("limit", strconv.Itoa(queriesPageSize))
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		page, next, err := getQueriesPage("http://" + apiAddress + path + "?" + params.Encode())
+		if err != nil {
+			return "", err
+		}
+		queries = append(queries, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	data, err := json.Marshal(queries)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func getQueriesPage(pageURL string) ([]json.RawMessage, string, error) {
+	resp, err := http.Get(pageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("proxy API returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read proxy response: %v", err)
+	}
+	var page []json.RawMessage
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, "", fmt.Errorf("failed to decode proxy response: %v", err)
+	}
+	return page, resp.Header.Get("X-Next-Cursor"), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// githubAPIURL returns the base URL of the GitHub REST API, which Actions
+// sets in GITHUB_API_URL for GitHub Enterprise Server, and which can point
+// at a stand-in server when testing
+func githubAPIURL() string {
+	if apiURL := os.Getenv("GITHUB_API_URL"); apiURL != "" {
+		return strings.TrimSuffix(apiURL, "/")
+	}
+	return "https://api.github.com"
+}
+
+// githubRequest calls the GitHub REST API, encoding body as JSON when it
+// isn't nil, and returns the response if its status is 2xx, or else a
+// *githubError
+func githubRequest(method, url, token string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &githubError{
+			method:     method,
+			url:        url,
+			status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(message)),
+		}
+	}
+	return resp, nil
+}
+
+// githubError is the answer of the GitHub API to a request that failed,
+// with the start of its body as the message
+type githubError struct {
+	method, url, status string
+	StatusCode          int
+	Message             string
+}
+
+func (e *githubError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.method, e.url, e.status, e.Message)
+}
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPageURL returns the URL of the next page of a paginated response,
+// empty on the last page
+func nextPageURL(resp *http.Response) string {
+	if m := nextLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// pullRequestNumber returns the number of the pull request the workflow
+// runs for, from the event payload or the ref of a pull_request event
+func pullRequestNumber() (int, bool) {
+	if eventPath := os.Getenv("GITHUB_EVENT_PATH"); eventPath != "" {
+		var event struct {
+			PullRequest struct {
+				Number int `json:"number"`
+			} `json:"pull_request"`
+		}
+		if data, err := os.ReadFile(eventPath); err == nil && json.Unmarshal(data, &event) == nil && event.PullRequest.Number > 0 {
+			return event.PullRequest.Number, true
+		}
+	}
+	// refs/pull/123/merge
+	if ref, ok := strings.CutPrefix(os.Getenv("GITHUB_REF"), "refs/pull/"); ok {
+		number, _, _ := strings.Cut(ref, "/")
+		if n, err := strconv.Atoi(number); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
@@ -2,4 +2,14 @@ module github.com/droptableifexists/recon
 
 go 1.21.3
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/droptableifexists/recon/sql-proxy v0.0.0
+	github.com/lib/pq v1.10.9
+)
+
+require (
+	go.etcd.io/bbolt v1.3.10 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
+
+replace github.com/droptableifexists/recon/sql-proxy => ./sql-proxy
@@ -1,21 +1,23 @@
 package main
 
 import (
-	"archive/zip"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"sort"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/droptableifexists/recon/sql-proxy/sqlnorm"
 	_ "github.com/lib/pq"
 )
 
 type Query struct {
-	Query string `json:"Query"`
+	Query       string        `json:"Query"`
+	Fingerprint string        `json:"Fingerprint,omitempty"`
+	Parameters  []*string     `json:"Parameters,omitempty"`
+	Duration    time.Duration `json:"Duration,omitempty"`
+	CommandTag  string        `json:"CommandTag,omitempty"`
+	Rows        int64         `json:"Rows,omitempty"`
 }
 
 type TableDiff struct {
@@ -48,24 +50,28 @@ type ConstraintDiff struct {
 }
 
 func main() {
+	countThresholds, gateCounts, err := loadCountThresholds()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure query count check: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Call the proxy's API
 	apiAddress := os.Getenv("SQL_PROXY_API_ADDRESS")
-	fmt.Println("Calling proxy API on address", apiAddress)
-	resp, err := http.Get("http://" + apiAddress + "/queries")
+	body, err := GetExecutedQueries(apiAddress, os.Getenv("SQL_PROXY_SESSION"))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to call proxy API: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to get executed queries: %v\n", err)
 		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	// Fetch baseline queries (optional)
+	provider, err := loadBaselineProvider()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read proxy response: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to configure baseline: %v\n", err)
 		os.Exit(1)
 	}
-
-	// Fetch baseline artifact queries (optional)
-	queriesBaseline := getArtifactFromMain("sql-queries")
+	baseline := loadBaselineSelector(githubAPIURL(), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_TOKEN"))
+	queriesBaseline := fetchBaseline(provider, "sql-queries", baseline)
 
 	// Generate JSON diff
 	queryDiff := diffQueries(string(body), queriesBaseline)
@@ -91,7 +97,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	schemaBaseline := getArtifactFromMain("full-schema")
+	schemaBaseline := fetchBaseline(provider, "full-schema", baseline)
 
 	// Parse the baseline schema from JSON string
 	var baselineSchema []DatabaseSchema
@@ -113,154 +119,143 @@ func main() {
 		os.Exit(1)
 	}
 
-	output := fmt.Sprintf("sql-queries=%s\nqueries-diff=%s\nschema=%s\nschema-diff=%s\n",
-		escapeMultiline(string(body)),
-		escapeMultiline(string(queryWithPlansJSON)),
-		escapeMultiline(string(schemaJSON)),
-		escapeMultiline(string(schemaDiffJSON)))
-	if err := os.WriteFile(outputPath, []byte(output), 0644); err != nil {
+	files := []outputFile{
+		{name: "sql-queries", file: "sql-queries.json", data: []byte(body)},
+		{name: "queries-diff", file: "queries-diff.json", data: queryWithPlansJSON},
+		{name: "schema", file: "full-schema.json", data: schemaJSON},
+		{name: "schema-diff", file: "schema-diff.json", data: schemaDiffJSON},
+	}
+	var outputs []output
+	// Large suites outgrow step outputs, so they can be written to files
+	// with only their paths as outputs
+	if outputDir := os.Getenv("OUTPUT_DIR"); outputDir != "" {
+		outputs, err = writeOutputFiles(outputDir, files)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write output files: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		for _, f := range files {
+			outputs = append(outputs, output{name: f.name, value: string(f.data)})
+		}
+	}
+
+	report := MakeReport(string(body), queriesBaseline, queryDiff, queryWithPlans, schemaDiff)
+	outputs = append(outputs,
+		output{name: "query-count", value: strconv.Itoa(report.TotalQueries)},
+		output{name: "new-query-count", value: strconv.Itoa(len(report.NewQueries))},
+		output{name: "removed-query-count", value: strconv.Itoa(len(report.RemovedQueries))},
+		output{name: "schema-change-count", value: strconv.Itoa(len(report.SchemaChanges))})
+	if err := writeOutputs(outputPath, outputs); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to write GITHUB_OUTPUT: %v\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Println("Successfully wrote queries, diff, and schema to GITHUB_OUTPUT.")
-}
-
-// Fetch and extract the sql-queries-main artifact content (JSON string)
-func getArtifactFromMain(name string) string {
-	repo := os.Getenv("GITHUB_REPOSITORY") // owner/repo
-	token := os.Getenv("GITHUB_TOKEN")     // GitHub token
 
-	if repo == "" || token == "" {
-		fmt.Fprintf(os.Stderr, "Warning: GITHUB_REPOSITORY or GITHUB_TOKEN not set\n")
-		return ""
+	if os.Getenv("BASELINE_PUBLISH") == "true" {
+		publishBaseline(provider, map[string][]byte{
+			"sql-queries": []byte(body),
+			"full-schema": schemaJSON,
+		})
 	}
 
-	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/actions/artifacts", repo)
-	req, _ := http.NewRequest("GET", apiURL, nil)
-	req.Header.Set("Authorization", "token "+token)
-	client := &http.Client{}
-
-	type Artifact struct {
-		Name        string `json:"name"`
-		ArchiveURL  string `json:"archive_download_url"`
-		CreatedAt   string `json:"created_at"`
-		WorkflowRun struct {
-			HeadBranch string `json:"head_branch"`
-		} `json:"workflow_run"`
+	if summaryPath := os.Getenv("GITHUB_STEP_SUMMARY"); summaryPath != "" {
+		if err := appendFile(summaryPath, report.Markdown(summaryLimit, "See the queries-diff and schema-diff outputs for the rest.")); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to write job summary: %v\n", err)
+		}
 	}
-	type ArtifactsResponse struct {
-		TotalCount int        `json:"total_count"`
-		Artifacts  []Artifact `json:"artifacts"`
+	if os.Getenv("PR_COMMENT") == "true" {
+		postReportComment(report.Markdown(commentReportLimit, "See the job summary of the workflow run for the rest."))
 	}
 
-	// Add name parameter and increase per_page to 100
-	apiURL = fmt.Sprintf("%s?per_page=100&name=%s", apiURL, name)
-	req, _ = http.NewRequest("GET", apiURL, nil)
-	req.Header.Set("Authorization", "token "+token)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to list artifacts: %v\n", err)
-		return ""
+	// Fail only once the outputs are written, so the report still shows
+	// what changed
+	if gateCounts {
+		if queriesBaseline == "" {
+			fmt.Fprintf(os.Stderr, "Warning: No baseline queries, skipping the query count check\n")
+		} else if regressions := CompareQueryCounts(string(body), queriesBaseline, countThresholds); len(regressions) > 0 {
+			fmt.Fprintf(os.Stderr, "Query counts grew by more than %s over the baseline:\n", countThresholds)
+			for _, r := range regressions {
+				fmt.Fprintf(os.Stderr, "  %s\n", r)
+			}
+			os.Exit(1)
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to read artifact list response: %v\n", err)
-		return ""
+// postReportComment posts report on the pull request the workflow runs
+// for. A report that can't be posted only warns, as the outputs are
+// already written.
+func postReportComment(report string) {
+	repo := os.Getenv("GITHUB_REPOSITORY")
+	token := os.Getenv("GITHUB_TOKEN")
+	if repo == "" || token == "" {
+		fmt.Fprintf(os.Stderr, "Warning: GITHUB_REPOSITORY or GITHUB_TOKEN not set, not commenting on the pull request\n")
+		return
 	}
-
-	var artifactsResp ArtifactsResponse
-	if err := json.Unmarshal(body, &artifactsResp); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to decode artifact list: %v\n", err)
-		return ""
+	pr, ok := pullRequestNumber()
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Warning: Not running for a pull request, not commenting\n")
+		return
 	}
-
-	var candidates []Artifact
-	for _, a := range artifactsResp.Artifacts {
-		// Check if this is a main branch artifact
-		if a.WorkflowRun.HeadBranch == "main" {
-			// Check if name matches what we're looking for
-			if strings.Contains(strings.ToLower(a.Name), strings.ToLower(name)) {
-				candidates = append(candidates, a)
-			}
-		}
+	if err := PostReportComment(githubAPIURL(), repo, token, pr, report); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to comment on pull request #%d: %v\n", pr, err)
+		return
 	}
+	fmt.Printf("Posted report on pull request #%d\n", pr)
+}
 
-	if len(candidates) == 0 {
-		fmt.Fprintf(os.Stderr, "Warning: No suitable baseline artifact from main branch found\n")
+// fetchBaseline returns the baseline file name of the run the selector
+// picks, empty when there is none. Without a baseline everything counts as
+// new, so failures only warn.
+func fetchBaseline(provider BaselineProvider, name string, selector baselineSelector) string {
+	if !validRef(selector.commit) || !validRef(selector.branch) {
+		fmt.Fprintf(os.Stderr, "Warning: Invalid baseline %s\n", selector)
 		return ""
 	}
-
-	sort.Slice(candidates, func(i, j int) bool {
-		ti, _ := time.Parse(time.RFC3339, candidates[i].CreatedAt)
-		tj, _ := time.Parse(time.RFC3339, candidates[j].CreatedAt)
-		return ti.After(tj)
-	})
-
-	latest := candidates[0]
-	fmt.Fprintf(os.Stderr, "Selected artifact: %s (created at: %s)\n", latest.Name, latest.CreatedAt)
-
-	// Download the ZIP archive of the artifact
-	reqZip, _ := http.NewRequest("GET", latest.ArchiveURL, nil)
-	reqZip.Header.Set("Authorization", "token "+token)
-	respZip, err := client.Do(reqZip)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to download artifact zip: %v\n", err)
-		return ""
+	data, err := provider.Fetch(name, selector)
+	if err == nil && data == "" && selector.fallback {
+		branch := baselineSelector{branch: selector.branch}
+		fmt.Fprintf(os.Stderr, "Warning: No baseline %s from %s found, falling back to %s\n", name, selector, branch)
+		selector = branch
+		data, err = provider.Fetch(name, selector)
 	}
-	defer respZip.Body.Close()
-
-	tmpFile, err := os.CreateTemp("", "artifact-*.zip")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to create temp file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Warning: Failed to fetch baseline %s: %v\n", name, err)
 		return ""
 	}
-	defer os.Remove(tmpFile.Name()) // clean up
-
-	_, err = io.Copy(tmpFile, respZip.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to save artifact zip: %v\n", err)
-		return ""
+	if data == "" {
+		fmt.Fprintf(os.Stderr, "Warning: No suitable baseline %s from %s found\n", name, selector)
 	}
+	return data
+}
 
-	if err := tmpFile.Close(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to close temp file: %v\n", err)
-		return ""
+// publishBaseline saves the files of this run to provider, so later runs
+// can use them as their baseline. A run that can't be published only
+// warns, as the outputs are already written.
+func publishBaseline(provider BaselineProvider, files map[string][]byte) {
+	publisher, ok := provider.(BaselinePublisher)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Warning: The %s baseline provider can't publish, upload the outputs as artifacts instead\n", BaselineGitHub)
+		return
 	}
-
-	// Open ZIP and find queries.json
-	zipReader, err := zip.OpenReader(tmpFile.Name())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to open zip archive: %v\n", err)
-		return ""
+	run := loadPublishRun()
+	if run.commit == "" && run.branch == "" {
+		fmt.Fprintf(os.Stderr, "Warning: BASELINE_PUBLISH_COMMIT and BASELINE_PUBLISH_BRANCH not set, not publishing the baseline\n")
+		return
 	}
-	defer zipReader.Close()
-
-	for _, file := range zipReader.File {
-		if file.Name == "sql-queries.json" || file.Name == "full-schema.json" {
-			rc, err := file.Open()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: Failed to open queries.json in zip: %v\n", err)
-				return ""
-			}
-			defer rc.Close()
-
-			data, err := io.ReadAll(rc)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: Failed to read queries.json: %v\n", err)
-				return ""
-			}
-			fmt.Fprintf(os.Stderr, "Successfully fetched baseline queries.json\n")
-			return string(data)
+	if !validRef(run.commit) || !validRef(run.branch) {
+		fmt.Fprintf(os.Stderr, "Warning: Invalid commit %q or branch %q, not publishing the baseline\n", run.commit, run.branch)
+		return
+	}
+	for name, data := range files {
+		if err := publisher.Publish(name, data, run); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to publish baseline %s: %v\n", name, err)
+			return
 		}
 	}
-
-	fmt.Fprintf(os.Stderr, "Warning: queries.json not found in artifact\n")
-	return ""
+	fmt.Printf("Published baseline for %s\n", run)
 }
 
 func diffQueries(current, baseline string) []Query {
@@ -268,28 +263,34 @@ func diffQueries(current, baseline string) []Query {
 	json.Unmarshal([]byte(current), &currentQueries)
 	json.Unmarshal([]byte(baseline), &baselineQueries)
 
-	// Create a map of baseline queries for quick lookup
+	// Compare fingerprints rather than the raw SQL, so a query run with
+	// different constants, e.g. a random UUID per test, isn't new. They are
+	// computed here rather than read from the capture so baselines
+	// recorded before fingerprints existed compare the same way.
 	baselineMap := make(map[string]bool)
 	for _, q := range baselineQueries {
-		baselineMap[q.Query] = true
+		baselineMap[sqlnorm.Fingerprint(q.Query)] = true
 	}
 
-	// Find new queries
+	// Find new queries, keeping the first run of each
 	var newQueries []Query
 	for _, q := range currentQueries {
-		if !baselineMap[q.Query] {
+		fingerprint := sqlnorm.Fingerprint(q.Query)
+		if !baselineMap[fingerprint] {
+			q.Fingerprint = fingerprint
 			newQueries = append(newQueries, q)
+			baselineMap[fingerprint] = true
 		}
 	}
 
 	return newQueries
 }
 
-// Escape multiline output for GitHub output file
-func escapeMultiline(input string) string {
-	s := strings.ReplaceAll(input, "%", "%25")
-	s = strings.ReplaceAll(s, "\n", "%0A")
-	s = strings.ReplaceAll(s, "\r", "%0D")
-	fmt.Print("s: ", s)
-	return s
+// Helper function to get environment variables with defaults
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
 }
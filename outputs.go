@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// output is a step output written to GITHUB_OUTPUT
+type output struct {
+	name  string
+	value string
+}
+
+// outputFile is a large output written to a file in output-directory mode
+// rather than to GITHUB_OUTPUT
+type outputFile struct {
+	// Name of the output holding the content, which becomes name-file in
+	// output-directory mode
+	name string
+	file string
+	data []byte
+}
+
+// writeOutputFiles writes files to dir and returns outputs holding their
+// paths
+func writeOutputFiles(dir string, files []outputFile) ([]output, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var outputs []output
+	for _, f := range files {
+		path := filepath.Join(dir, f.file)
+		if err := os.WriteFile(path, f.data, 0644); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output{name: f.name + "-file", value: path})
+	}
+	return outputs, nil
+}
+
+// writeOutputs appends outputs to the GITHUB_OUTPUT file at path. Values
+// spanning lines are written between heredoc delimiters, which GitHub
+// requires instead of escaping the newlines.
+func writeOutputs(path string, outputs []output) error {
+	var b strings.Builder
+	for _, o := range outputs {
+		if !strings.ContainsAny(o.value, "\r\n") {
+			fmt.Fprintf(&b, "%s=%s\n", o.name, o.value)
+			continue
+		}
+		delimiter, err := outputDelimiter(o.value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s<<%s\n%s\n%s\n", o.name, delimiter, o.value, delimiter)
+	}
+	return appendFile(path, b.String())
+}
+
+// outputDelimiter returns a random delimiter that doesn't occur in value
+func outputDelimiter(value string) (string, error) {
+	for {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		delimiter := "ghadelimiter_" + hex.EncodeToString(random)
+		if !strings.Contains(value, delimiter) {
+			return delimiter, nil
+		}
+	}
+}
+
+// summaryLimit is the size of the job summary of a step above which GitHub
+// drops it entirely
+const summaryLimit = 1024 * 1024
+
+// appendFile appends content to the file at path, as GITHUB_OUTPUT and the
+// job summary may already hold what other steps wrote
+func appendFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reportMarker tags the pull request comment recon keeps up to date, so
+// reruns edit it instead of adding another
+const reportMarker = "<!-- recon-report -->"
+
+// commentReportLimit is the longest report that fits in a comment with
+// its marker, as GitHub rejects comments over 65536 characters
+const commentReportLimit = 65536 - len(reportMarker) - 1
+
+// actionsBot is the user the GITHUB_TOKEN of GitHub Actions comments as
+const actionsBot = "github-actions[bot]"
+
+type issueComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// PostReportComment creates the comment holding report on pull request
+// pr of repo, or updates the one recon posted before with the same token.
+// report must fit in commentReportLimit.
+func PostReportComment(apiURL, repo, token string, pr int, report string) error {
+	body := map[string]string{"body": reportMarker + "\n" + report}
+
+	login, err := tokenLogin(apiURL, token)
+	if err != nil {
+		return err
+	}
+	id, err := findReportComment(apiURL, repo, token, pr, login)
+	if err != nil {
+		return err
+	}
+	var resp *http.Response
+	if id == 0 {
+		resp, err = githubRequest(http.MethodPost, fmt.Sprintf("%s/repos/%s/issues/%d/comments", apiURL, repo, pr), token, body)
+	} else {
+		resp, err = githubRequest(http.MethodPatch, fmt.Sprintf("%s/repos/%s/issues/comments/%d", apiURL, repo, id), token, body)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// tokenLogin returns the login of the user token acts as. The GITHUB_TOKEN
+// of GitHub Actions can't read the authenticated user, which is how it is
+// told apart from personal access tokens.
+func tokenLogin(apiURL, token string) (string, error) {
+	resp, err := githubRequest(http.MethodGet, apiURL+"/user", token, nil)
+	var ghErr *githubError
+	if errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusForbidden &&
+		strings.Contains(ghErr.Message, "Resource not accessible by integration") {
+		return actionsBot, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get the user of the token: %v", err)
+	}
+	defer resp.Body.Close()
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", fmt.Errorf("failed to decode user: %v", err)
+	}
+	return user.Login, nil
+}
+
+// findReportComment returns the ID of the comment with reportMarker that
+// login posted on pull request pr, or 0 when there is none. Comments of
+// others can't be edited, even when they hold the marker.
+func findReportComment(apiURL, repo, token string, pr int, login string) (int64, error) {
+	url := fmt.Sprintf("%s/repos/%s/issues/%d/comments?per_page=100", apiURL, repo, pr)
+	for url != "" {
+		resp, err := githubRequest(http.MethodGet, url, token, nil)
+		if err != nil {
+			return 0, err
+		}
+		var comments []issueComment
+		err = json.NewDecoder(resp.Body).Decode(&comments)
+		resp.Body.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode comments: %v", err)
+		}
+		for _, c := range comments {
+			if c.User.Login == login && strings.Contains(c.Body, reportMarker) {
+				return c.ID, nil
+			}
+		}
+		url = nextPageURL(resp)
+	}
+	return 0, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitHub stands in for the issue comments API of one pull request
+type fakeGitHub struct {
+	t *testing.T
+	// Login of the token, empty to answer /user like the GITHUB_TOKEN of
+	// Actions does
+	login string
+	// Pages of the pull request's comments
+	pages [][]issueComment
+
+	mu      sync.Mutex
+	created []string
+	patched map[int64]string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token secret" {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Body string `json:"body"`
+	}
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.t.Errorf("decoding %s %s: %v", r.Method, r.URL, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/user":
+		if f.login == "" {
+			http.Error(w, "Resource not accessible by integration", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"login": %q}`, f.login)
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/repo/issues/7/comments":
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+		if page+1 < len(f.pages) {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?per_page=100&page=%d>; rel="next"`, r.Host, r.URL.Path, page+1))
+		}
+		comments := []issueComment{}
+		if page < len(f.pages) {
+			comments = f.pages[page]
+		}
+		json.NewEncoder(w).Encode(comments)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/owner/repo/issues/7/comments":
+		f.created = append(f.created, body.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/repos/owner/repo/issues/comments/"):
+		var id int64
+		fmt.Sscan(strings.TrimPrefix(r.URL.Path, "/repos/owner/repo/issues/comments/"), &id)
+		f.patched[id] = body.Body
+		w.Write([]byte(`{}`))
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func comment(id int64, login, body string) issueComment {
+	c := issueComment{ID: id, Body: body}
+	c.User.Login = login
+	return c
+}
+
+// postReport posts report through a stand-in server set as GITHUB_API_URL
+func postReport(t *testing.T, f *fakeGitHub, report string) {
+	t.Helper()
+	f.t = t
+	f.patched = map[int64]string{}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	t.Setenv("GITHUB_API_URL", server.URL)
+
+	if err := PostReportComment(githubAPIURL(), "owner/repo", "secret", 7, report); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostReportCommentCreates(t *testing.T) {
+	f := &fakeGitHub{
+		pages: [][]issueComment{{
+			comment(1, actionsBot, "Unrelated"),
+			// Someone quoting the report can't have their comment edited
+			comment(2, "octocat", "> "+reportMarker+"\n> ## recon"),
+		}},
+	}
+	postReport(t, f, "## recon")
+
+	if len(f.created) != 1 || len(f.patched) != 0 {
+		t.Fatalf("created %d and patched %d comments, want 1 created", len(f.created), len(f.patched))
+	}
+	if want := reportMarker + "\n## recon"; f.created[0] != want {
+		t.Errorf("created %q, want %q", f.created[0], want)
+	}
+}
+
+func TestPostReportCommentUpdates(t *testing.T) {
+	f := &fakeGitHub{
+		login: "recon-bot",
+		pages: [][]issueComment{{
+			comment(1, "octocat", "LGTM"),
+			comment(2, "recon-bot", reportMarker+"\n## recon\nold"),
+		}},
+	}
+	postReport(t, f, "## recon\nnew")
+
+	if len(f.created) != 0 {
+		t.Fatalf("created %d comments, want the existing one updated", len(f.created))
+	}
+	if want := reportMarker + "\n## recon\nnew"; f.patched[2] != want {
+		t.Errorf("comment 2 is %q, want %q", f.patched[2], want)
+	}
+}
+
+func TestPostReportCommentFindsMarkerOnLaterPage(t *testing.T) {
+	first := make([]issueComment, 100)
+	for i := range first {
+		first[i] = comment(int64(i+1), "octocat", "Comment")
+	}
+	f := &fakeGitHub{
+		pages: [][]issueComment{
+			first,
+			{comment(101, actionsBot, reportMarker+"\n## recon\nold")},
+		},
+	}
+	postReport(t, f, "## recon\nnew")
+
+	if len(f.created) != 0 || len(f.patched) != 1 {
+		t.Fatalf("created %d and patched %d comments, want comment 101 updated", len(f.created), len(f.patched))
+	}
+	if _, ok := f.patched[101]; !ok {
+		t.Errorf("patched %v, want comment 101", f.patched)
+	}
+}
+
+func TestReportMarkdownFitsCommentLimit(t *testing.T) {
+	r := Report{Plans: map[string]string{}}
+	for i := 0; i < 1000; i++ {
+		q := Query{Query: fmt.Sprintf("SELECT c%d FROM t WHERE id = $1", i), Fingerprint: fmt.Sprint(i)}
+		r.NewQueries = append(r.NewQueries, q)
+		r.Plans[q.Fingerprint] = strings.Repeat("Index Scan using t_pkey on t  (cost=0.15..8.17 rows=1 width=4)\n", 3)
+	}
+	markdown := r.Markdown(commentReportLimit, "See the job summary.")
+	if len(markdown) > commentReportLimit {
+		t.Fatalf("report is %d bytes, want at most %d", len(markdown), commentReportLimit)
+	}
+	if !strings.HasSuffix(markdown, "See the job summary.\n") {
+		t.Errorf("report doesn't end with the truncation note")
+	}
+	if opened, closed := strings.Count(markdown, "<details>"), strings.Count(markdown, "</details>"); opened != closed {
+		t.Errorf("report opens %d and closes %d details", opened, closed)
+	}
+}
+
+func TestTokenLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"personal access token", http.StatusOK, `{"login": "octocat"}`, "octocat", false},
+		{"GITHUB_TOKEN", http.StatusForbidden, `{"message": "Resource not accessible by integration"}`, actionsBot, false},
+		// Only the GITHUB_TOKEN answer means the comments are the bot's
+		{"rate limited", http.StatusForbidden, `{"message": "API rate limit exceeded"}`, "", true},
+		{"bad credentials", http.StatusUnauthorized, `{"message": "Bad credentials"}`, "", true},
+		{"server error", http.StatusBadGateway, `{"message": "Server Error"}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			got, err := tokenLogin(server.URL, "secret")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("tokenLogin() = %q, %v, want %q with error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
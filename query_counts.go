@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/droptableifexists/recon/sql-proxy/sqlnorm"
+)
+
+// CountThresholds bounds how much query counts may grow over the
+// baseline. A threshold below 0 isn't checked.
+type CountThresholds struct {
+	MaxIncrease        int
+	MaxIncreasePercent float64
+}
+
+// CountRegression is a query count that grew beyond the thresholds
+type CountRegression struct {
+	// Empty for the total count of queries
+	Fingerprint string
+	// The normalized query
+	Query    string
+	Baseline int
+	Current  int
+}
+
+func (r CountRegression) String() string {
+	increase := r.Current - r.Baseline
+	name := "total"
+	if r.Fingerprint != "" {
+		name = r.Fingerprint + " " + r.Query
+	}
+	return fmt.Sprintf("%s: %d -> %d (+%d, +%.1f%%)", name, r.Baseline, r.Current,
+		increase, 100*float64(increase)/float64(r.Baseline))
+}
+
+// loadCountThresholds reads QUERY_COUNT_MAX_INCREASE and
+// QUERY_COUNT_MAX_INCREASE_PERCENT, and reports whether either is set
+func loadCountThresholds() (CountThresholds, bool, error) {
+	t := CountThresholds{MaxIncrease: -1, MaxIncreasePercent: -1}
+	var err error
+	if v := os.Getenv("QUERY_COUNT_MAX_INCREASE"); v != "" {
+		if t.MaxIncrease, err = strconv.Atoi(v); err != nil || t.MaxIncrease < 0 {
+			return t, false, fmt.Errorf("invalid QUERY_COUNT_MAX_INCREASE %q, expected a count", v)
+		}
+	}
+	if v := os.Getenv("QUERY_COUNT_MAX_INCREASE_PERCENT"); v != "" {
+		if t.MaxIncreasePercent, err = strconv.ParseFloat(v, 64); err != nil || t.MaxIncreasePercent < 0 {
+			return t, false, fmt.Errorf("invalid QUERY_COUNT_MAX_INCREASE_PERCENT %q, expected a percentage", v)
+		}
+	}
+	return t, t.MaxIncrease >= 0 || t.MaxIncreasePercent >= 0, nil
+}
+
+// exceeded reports whether growing from baseline to current breaks any of
+// the thresholds
+func (t CountThresholds) exceeded(baseline, current int) bool {
+	increase := current - baseline
+	if increase <= 0 {
+		return false
+	}
+	if t.MaxIncrease >= 0 && increase > t.MaxIncrease {
+		return true
+	}
+	return t.MaxIncreasePercent >= 0 && float64(increase) > t.MaxIncreasePercent*float64(baseline)/100
+}
+
+func (t CountThresholds) String() string {
+	var limits []string
+	if t.MaxIncrease >= 0 {
+		limits = append(limits, fmt.Sprintf("+%d", t.MaxIncrease))
+	}
+	if t.MaxIncreasePercent >= 0 {
+		limits = append(limits, fmt.Sprintf("+%g%%", t.MaxIncreasePercent))
+	}
+	return strings.Join(limits, " or ")
+}
+
+// CompareQueryCounts returns the total count of queries if it grew beyond
+// the thresholds, followed by each fingerprint of the baseline whose count
+// did, largest increase first. Fingerprints new since the baseline are
+// left to the queries diff.
+func CompareQueryCounts(current, baseline string, t CountThresholds) []CountRegression {
+	var currentQueries, baselineQueries []Query
+	json.Unmarshal([]byte(current), &currentQueries)
+	json.Unmarshal([]byte(baseline), &baselineQueries)
+
+	var regressions []CountRegression
+	if len(baselineQueries) == 0 {
+		return regressions
+	}
+	if t.exceeded(len(baselineQueries), len(currentQueries)) {
+		regressions = append(regressions, CountRegression{
+			Baseline: len(baselineQueries),
+			Current:  len(currentQueries),
+		})
+	}
+
+	baselineCounts := countByFingerprint(baselineQueries)
+	var grown []CountRegression
+	for fingerprint, c := range countByFingerprint(currentQueries) {
+		b, ok := baselineCounts[fingerprint]
+		if !ok || !t.exceeded(b.count, c.count) {
+			continue
+		}
+		grown = append(grown, CountRegression{
+			Fingerprint: fingerprint,
+			Query:       c.query,
+			Baseline:    b.count,
+			Current:     c.count,
+		})
+	}
+	sort.Slice(grown, func(i, j int) bool {
+		return grown[i].Current-grown[i].Baseline > grown[j].Current-grown[j].Baseline
+	})
+	return append(regressions, grown...)
+}
+
+type fingerprintCount struct {
+	query string
+	count int
+}
+
+func countByFingerprint(queries []Query) map[string]*fingerprintCount {
+	counts := map[string]*fingerprintCount{}
+	for _, q := range queries {
+		fingerprint := sqlnorm.Fingerprint(q.Query)
+		c, ok := counts[fingerprint]
+		if !ok {
+			c = &fingerprintCount{query: sqlnorm.Normalize(q.Query)}
+			counts[fingerprint] = c
+		}
+		c.count++
+	}
+	return counts
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/droptableifexists/recon/sql-proxy/sqlnorm"
+)
+
+// Report is what recon found, rendered for the pull request comment and
+// the job summary
+type Report struct {
+	// Queries the tests ran, and how many distinct fingerprints they had
+	TotalQueries    int
+	DistinctQueries int
+	// Queries whose fingerprint is new since the baseline, or gone from it
+	NewQueries     []Query
+	RemovedQueries []Query
+	// EXPLAIN plans of the new queries by fingerprint, missing when the
+	// query couldn't be explained
+	Plans         map[string]string
+	SchemaChanges []TableChanges
+}
+
+// MakeReport builds the report from the captured queries, the new ones
+// with their plans, and the baseline queries
+func MakeReport(current, baseline string, newQueries []Query, plans []QueryWithPlan, schemaChanges []TableChanges) Report {
+	var currentQueries []Query
+	json.Unmarshal([]byte(current), &currentQueries)
+	distinct := map[string]bool{}
+	for _, q := range currentQueries {
+		distinct[sqlnorm.Fingerprint(q.Query)] = true
+	}
+
+	r := Report{
+		TotalQueries:    len(currentQueries),
+		DistinctQueries: len(distinct),
+		NewQueries:      newQueries,
+		Plans:           map[string]string{},
+		SchemaChanges:   schemaChanges,
+	}
+	if baseline != "" {
+		r.RemovedQueries = diffQueries(baseline, current)
+	}
+	for _, p := range plans {
+		r.Plans[p.Fingerprint] = p.Plan
+	}
+	return r
+}
+
+// Markdown renders the report in at most limit bytes, or without a limit
+// when it is 0. Sections that don't fit are left out whole, so the
+// Markdown stays valid, and a note saying so ends with more.
+func (r Report) Markdown(limit int, more string) string {
+	blocks := r.markdownBlocks()
+	truncated := fmt.Sprintf("\n**Report truncated.** %s\n", more)
+	var b strings.Builder
+	for i, block := range blocks {
+		need := len(block)
+		// Unless this is the last block, leave room for the note
+		if i < len(blocks)-1 {
+			need += len(truncated)
+		}
+		if limit > 0 && i > 0 && b.Len()+need > limit {
+			b.WriteString(truncated)
+			break
+		}
+		b.WriteString(block)
+	}
+	return b.String()
+}
+
+// markdownBlocks renders the report as blocks that are valid Markdown
+// when cut after any of them, the first being the summary table
+func (r Report) markdownBlocks() []string {
+	var blocks []string
+	var b strings.Builder
+	next := func() {
+		blocks = append(blocks, b.String())
+		b.Reset()
+	}
+
+	b.WriteString("## recon\n\n")
+	b.WriteString("| Queries run | Distinct | New | Removed | Schema changes |\n| --- | --- | --- | --- | --- |\n")
+	fmt.Fprintf(&b, "| %d | %d | %d | %d | %d |\n\n", r.TotalQueries, r.DistinctQueries,
+		len(r.NewQueries), len(r.RemovedQueries), len(r.SchemaChanges))
+	next()
+
+	fmt.Fprintf(&b, "### New queries (%d)\n\n", len(r.NewQueries))
+	if len(r.NewQueries) == 0 {
+		b.WriteString("No new queries.\n\n")
+	}
+	next()
+	for _, q := range r.NewQueries {
+		fmt.Fprintf(&b, "<details>\n<summary><code>%s</code></summary>\n\n", escapeHTML(summarize(q.Query, 100)))
+		writeCodeBlock(&b, "sql", q.Query)
+		if q.Duration > 0 || q.CommandTag != "" {
+			fmt.Fprintf(&b, "Ran in %s", q.Duration)
+			if q.CommandTag != "" {
+				fmt.Fprintf(&b, ", `%s`", q.CommandTag)
+			}
+			b.WriteString("\n\n")
+		}
+		if plan, ok := r.Plans[q.Fingerprint]; ok {
+			writeCodeBlock(&b, "", plan)
+		} else {
+			b.WriteString("No plan, EXPLAIN failed.\n\n")
+		}
+		b.WriteString("</details>\n\n")
+		next()
+	}
+
+	if len(r.RemovedQueries) > 0 {
+		fmt.Fprintf(&b, "### Removed queries (%d)\n\n<details>\n<summary>Queries the baseline ran that no longer run</summary>\n\n", len(r.RemovedQueries))
+		for _, q := range r.RemovedQueries {
+			fmt.Fprintf(&b, "- `%s`\n", strings.ReplaceAll(summarize(q.Query, 200), "`", "'"))
+		}
+		b.WriteString("\n</details>\n\n")
+		next()
+	}
+
+	fmt.Fprintf(&b, "### Schema changes (%d)\n\n", len(r.SchemaChanges))
+	if len(r.SchemaChanges) == 0 {
+		b.WriteString("No schema changes.\n")
+		next()
+		return blocks
+	}
+	b.WriteString("| Database | Table | Changes |\n| --- | --- | --- |\n")
+	next()
+	for _, t := range r.SchemaChanges {
+		fmt.Fprintf(&b, "| %s | %s.%s | %s |\n", escapeTableCell(t.Database), escapeTableCell(t.Schema),
+			escapeTableCell(t.Table), escapeTableCell(strings.Join(describeTableChanges(t), "; ")))
+		next()
+	}
+	return blocks
+}
+
+// describeTableChanges lists the columns, indexes and constraints that
+// differ between the old and new version of a table
+func describeTableChanges(t TableChanges) []string {
+	var changes []string
+	if t.Old == nil || t.New == nil {
+		return changes
+	}
+
+	oldColumns := map[string]ColumnSchema{}
+	for _, c := range t.Old.Columns {
+		oldColumns[c.Name] = c
+	}
+	newColumns := map[string]bool{}
+	for _, c := range t.New.Columns {
+		newColumns[c.Name] = true
+		old, ok := oldColumns[c.Name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("added column %s %s", c.Name, c.Type))
+		case old.Type != c.Type:
+			changes = append(changes, fmt.Sprintf("column %s type %s -> %s", c.Name, old.Type, c.Type))
+		}
+		if ok && old.Nullable != c.Nullable {
+			if c.Nullable {
+				changes = append(changes, fmt.Sprintf("column %s now nullable", c.Name))
+			} else {
+				changes = append(changes, fmt.Sprintf("column %s now not null", c.Name))
+			}
+		}
+		if ok && old.Default != c.Default {
+			changes = append(changes, fmt.Sprintf("column %s default %q -> %q", c.Name, old.Default, c.Default))
+		}
+	}
+	for _, c := range t.Old.Columns {
+		if !newColumns[c.Name] {
+			changes = append(changes, fmt.Sprintf("removed column %s", c.Name))
+		}
+	}
+
+	var oldIndexes, newIndexes, oldConstraints, newConstraints []string
+	for _, i := range t.Old.Indexes {
+		oldIndexes = append(oldIndexes, i.Definition)
+	}
+	for _, i := range t.New.Indexes {
+		newIndexes = append(newIndexes, i.Definition)
+	}
+	for _, c := range t.Old.Constraints {
+		oldConstraints = append(oldConstraints, c.Definition)
+	}
+	for _, c := range t.New.Constraints {
+		newConstraints = append(newConstraints, c.Definition)
+	}
+	changes = append(changes, describeDefinitions("index", oldIndexes, newIndexes)...)
+	return append(changes, describeDefinitions("constraint", oldConstraints, newConstraints)...)
+}
+
+// describeDefinitions lists the definitions added and removed between old
+// and new
+func describeDefinitions(kind string, old, new []string) []string {
+	var changes []string
+	inOld := map[string]bool{}
+	for _, d := range old {
+		inOld[d] = true
+	}
+	inNew := map[string]bool{}
+	for _, d := range new {
+		inNew[d] = true
+		if !inOld[d] {
+			changes = append(changes, fmt.Sprintf("added %s `%s`", kind, d))
+		}
+	}
+	for _, d := range old {
+		if !inNew[d] {
+			changes = append(changes, fmt.Sprintf("removed %s `%s`", kind, d))
+		}
+	}
+	return changes
+}
+
+// writeCodeBlock writes code in a fence longer than any run of backticks
+// it holds
+func writeCodeBlock(b *strings.Builder, language, code string) {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(b, "%s%s\n%s\n%s\n\n", fence, language, strings.TrimRight(code, "\n"), fence)
+}
+
+// summarize collapses whitespace and cuts s to at most max characters
+func summarize(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > max {
+		return string(runes[:max-1]) + "…"
+	}
+	return s
+}
+
+func escapeHTML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func escapeTableCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReportSchemaChangesOrder(t *testing.T) {
+	table := func(schema, name, column string) TableSchema {
+		return TableSchema{Name: name, Schema: schema, Columns: []ColumnSchema{{Name: column, Type: "integer"}}}
+	}
+	database := func(name string, column string) DatabaseSchema {
+		return DatabaseSchema{Database: name, Tables: map[string]TableSchema{
+			"users":    table("app", "users", column),
+			"orders":   table("app", "orders", column),
+			"accounts": table("billing", "accounts", column),
+		}}
+	}
+	current := []DatabaseSchema{database("shop", "b"), database("audit", "b"), database("crm", "b")}
+	baseline := []DatabaseSchema{database("crm", "a"), database("shop", "a"), database("audit", "a")}
+
+	want := []string{
+		"| audit | app.orders |", "| audit | app.users |", "| audit | billing.accounts |",
+		"| crm | app.orders |", "| crm | app.users |", "| crm | billing.accounts |",
+		"| shop | app.orders |", "| shop | app.users |", "| shop | billing.accounts |",
+	}
+	// Map iteration differs between runs, so render a few times
+	for run := 0; run < 10; run++ {
+		r := Report{Plans: map[string]string{}, SchemaChanges: CompareSchema(current, baseline)}
+		var rows []string
+		for _, line := range strings.Split(r.Markdown(0, ""), "\n") {
+			if strings.HasPrefix(line, "| audit") || strings.HasPrefix(line, "| crm") || strings.HasPrefix(line, "| shop") {
+				rows = append(rows, line)
+			}
+		}
+		if len(rows) != len(want) {
+			t.Fatalf("got %d schema change rows, want %d", len(rows), len(want))
+		}
+		for i, prefix := range want {
+			if !strings.HasPrefix(rows[i], prefix) {
+				t.Fatalf("run %d: row %d is %q, want it to start with %q", run, i, rows[i], prefix)
+			}
+		}
+	}
+}
@@ -5,31 +5,148 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 
+	"github.com/droptableifexists/recon/sql-proxy/metrics"
 	"github.com/droptableifexists/recon/sql-proxy/store"
 )
 
 type QueriesExecutedAPI struct {
 	queryStore *store.QueryStore
+	// Reports why the proxy can't serve clients yet, nil once it can
+	checkReady func() error
 }
 
-func MakeQueriesExecutedAPI(qs *store.QueryStore) *QueriesExecutedAPI {
+func MakeQueriesExecutedAPI(qs *store.QueryStore, checkReady func() error) *QueriesExecutedAPI {
 	return &QueriesExecutedAPI{
 		queryStore: qs,
+		checkReady: checkReady,
 	}
 }
 
 func (api QueriesExecutedAPI) RunApi() {
-	http.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
-		if qe, err := json.Marshal(api.queryStore.ListQueries()); err == nil {
-			w.Write(qe)
-		} else {
-			fmt.Print(err)
-		}
-	})
+	http.HandleFunc("/queries", api.listQueries)
+	http.HandleFunc("/queries/stream", api.streamQueries)
+	http.HandleFunc("/transactions", api.listTransactions)
+	http.HandleFunc("/stats", api.listStats)
+	http.HandleFunc("/sessions", api.sessions)
+	http.HandleFunc("/sessions/", api.session)
+	http.HandleFunc("/metrics", api.metrics)
+	http.HandleFunc("/healthz", api.healthz)
+	http.HandleFunc("/readyz", api.readyz)
 
 	// Start the server on port 8080
 	apiPort := os.Getenv("API_PORT")
 	fmt.Println("Starting API on port", apiPort)
 	http.ListenAndServe(":"+apiPort, nil)
 }
+
+// listQueries returns the captured queries on GET and clears them on
+// DELETE. DELETE /queries?return=true also returns what was cleared, so a
+// harness can drop setup noise and keep it at once.
+func (api QueriesExecutedAPI) listQueries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		api.writeQueries(w, r, nil)
+	case http.MethodDelete:
+		queries, err := api.queryStore.ClearQueries()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("return") == "true" {
+			writeJSON(w, http.StatusOK, queries)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeQueries writes the page of stored queries selected by the request's
+// parameters, see queryFilter, out of those in scope, or all when scope is
+// nil. The body stays a plain JSON array; the X-Next-Cursor header holds
+// the cursor of the next page when there is one.
+func (api QueriesExecutedAPI) writeQueries(w http.ResponseWriter, r *http.Request, scope func(store.QueryExecuted) bool) {
+	f, err := parseQueryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, next := api.queryStore.PageQueries(f.cursor, f.limit, func(q store.QueryExecuted) bool {
+		return (scope == nil || scope(q)) && f.matches(q)
+	})
+	if next != 0 {
+		w.Header().Set("X-Next-Cursor", strconv.FormatUint(next, 10))
+	}
+
+	// Let callers know the list is incomplete when the store was full
+	w.Header().Set("X-Queries-Dropped", strconv.FormatUint(api.queryStore.Dropped(), 10))
+	if qe, err := json.Marshal(page); err == nil {
+		w.Write(qe)
+	} else {
+		fmt.Print(err)
+	}
+}
+
+// listStats returns the captured queries aggregated by fingerprint
+func (api QueriesExecutedAPI) listStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	api.writeStats(w, r, api.queryStore.ListQueries())
+}
+
+// writeStats aggregates the queries selected by the request's parameters,
+// see queryFilter. Stats cover every matching query, so limit and cursor
+// don't apply.
+func (api QueriesExecutedAPI) writeStats(w http.ResponseWriter, r *http.Request, queries []store.QueryExecuted) {
+	f, err := parseQueryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	matching := []store.QueryExecuted{}
+	for _, q := range queries {
+		if f.matches(q) {
+			matching = append(matching, q)
+		}
+	}
+	writeJSON(w, http.StatusOK, store.AggregateStats(matching))
+}
+
+// listTransactions returns the captured queries grouped by transaction
+// block, with each block's outcome and duration
+func (api QueriesExecutedAPI) listTransactions(w http.ResponseWriter, r *http.Request) {
+	if t, err := json.Marshal(api.queryStore.ListTransactions()); err == nil {
+		w.Write(t)
+	} else {
+		fmt.Print(err)
+	}
+}
+
+// metrics serves the proxy's metrics for Prometheus to scrape
+func (api QueriesExecutedAPI) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
+
+// healthz answers as long as the process is up
+func (api QueriesExecutedAPI) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz answers 200 once the proxy listens and can reach the backend,
+// and 503 with the reason until then, so CI can wait on it like on
+// pg_isready
+func (api QueriesExecutedAPI) readyz(w http.ResponseWriter, r *http.Request) {
+	if err := api.checkReady(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/droptableifexists/recon/sql-proxy/store"
+)
+
+// queryFilter selects captured queries from the parameters of a request:
+//
+//	status      error or ok
+//	since/until RFC 3339 bounds on the query's start time
+//	database    database the query ran against
+//	connection  ID of the connection the query ran on
+//	command     statement kind such as SELECT or INSERT
+//	contains    substring of the SQL text
+//	match       regular expression matched against the SQL text
+//	limit       maximum number of queries returned
+//	cursor      only queries after the one with this ID
+type queryFilter struct {
+	status       string
+	since, until time.Time
+	database     string
+	connection   uint64
+	command      string
+	contains     string
+	match        *regexp.Regexp
+	limit        int
+	cursor       uint64
+}
+
+func parseQueryFilter(r *http.Request) (queryFilter, error) {
+	params := r.URL.Query()
+	f := queryFilter{
+		status:   params.Get("status"),
+		database: params.Get("database"),
+		command:  strings.ToUpper(params.Get("command")),
+		contains: params.Get("contains"),
+	}
+	var err error
+
+	if f.status != "" && f.status != "error" && f.status != "ok" {
+		return f, fmt.Errorf("unknown status %q, expected error or ok", f.status)
+	}
+	if v := params.Get("since"); v != "" {
+		if f.since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return f, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if f.until, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return f, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if v := params.Get("connection"); v != "" {
+		if f.connection, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return f, fmt.Errorf("invalid connection: %v", err)
+		}
+	}
+	if v := params.Get("match"); v != "" {
+		if f.match, err = regexp.Compile(v); err != nil {
+			return f, fmt.Errorf("invalid match: %v", err)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit < 1 {
+			return f, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if v := params.Get("cursor"); v != "" {
+		if f.cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return f, fmt.Errorf("invalid cursor: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether q passes every filter except the page bounds
+func (f queryFilter) matches(q store.QueryExecuted) bool {
+	switch {
+	case f.status != "" && (q.Error != nil) != (f.status == "error"):
+		return false
+	case !f.since.IsZero() && q.StartTime.Before(f.since):
+		return false
+	case !f.until.IsZero() && q.StartTime.After(f.until):
+		return false
+	case f.database != "" && q.Database != f.database:
+		return false
+	case f.connection != 0 && q.ConnectionID != f.connection:
+		return false
+	case f.command != "" && q.Command() != f.command:
+		return false
+	case f.contains != "" && !strings.Contains(q.Query, f.contains):
+		return false
+	case f.match != nil && !f.match.MatchString(q.Query):
+		return false
+	}
+	return true
+}
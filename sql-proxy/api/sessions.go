@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sessions handles /sessions: GET lists the sessions, POST starts one from
+// an optional {"Name": ..., "ApplicationName": ...} body
+func (api QueriesExecutedAPI) sessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, api.queryStore.ListSessions())
+	case http.MethodPost:
+		var request struct {
+			Name            string
+			ApplicationName string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid session: %v", err), http.StatusBadRequest)
+			return
+		}
+		s, err := api.queryStore.StartSession(request.Name, request.ApplicationName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, s)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// session handles GET /sessions/{id}, POST /sessions/{id}/stop,
+// GET /sessions/{id}/queries and GET /sessions/{id}/stats
+func (api QueriesExecutedAPI) session(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+
+	var method string
+	switch action {
+	case "", "queries", "stats":
+		method = http.MethodGet
+	case "stop":
+		method = http.MethodPost
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "":
+		s, err := api.queryStore.GetSession(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case "stop":
+		s, err := api.queryStore.StopSession(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case "queries":
+		s, err := api.queryStore.GetSession(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		api.writeQueries(w, r, s.Contains)
+	case "stats":
+		queries, err := api.queryStore.ListSessionQueries(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		api.writeStats(w, r, queries)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
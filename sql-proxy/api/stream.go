@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How often an idle stream sends a comment so proxies keep it open
+const streamHeartbeat = 15 * time.Second
+
+// streamQueries pushes each captured query as a Server-Sent Event as soon
+// as it is stored. The filters of GET /queries apply, except limit and
+// cursor.
+func (api QueriesExecutedAPI) streamQueries(w http.ResponseWriter, r *http.Request) {
+	f, err := parseQueryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	queries, unsubscribe := api.queryStore.Subscribe(256)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case q := <-queries:
+			if !f.matches(q) {
+				continue
+			}
+			data, err := json.Marshal(q)
+			if err != nil {
+				fmt.Print(err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: query\ndata: %s\n\n", q.ID, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/droptableifexists/recon/sql-proxy/metrics"
+	"github.com/droptableifexists/recon/sql-proxy/pgwire"
+	"github.com/droptableifexists/recon/sql-proxy/store"
+)
+
+// capture turns the messages of one client connection into executed
+// queries. It tracks prepared statements and portals so an Execute can be
+// tied back to the SQL text of its Parse and the values of its Bind. Both
+// directions of the connection use it, so its state is guarded by mu.
+type capture struct {
+	queryStore        *store.QueryStore
+	captureParameters bool
+	conn              connectionInfo
+
+	mu         sync.Mutex
+	statements map[string]*statement
+	portals    map[string]*portal
+	// Statements described by the client, waiting for the backend's
+	// ParameterDescription
+	describes []string
+	// Queries sent by the client that the backend hasn't answered yet, in
+	// the order the backend will answer them
+	pending []*pendingQuery
+	// Queries the backend has answered, held until ReadyForQuery tells
+	// which transaction they ran in
+	completed []store.QueryExecuted
+	// Transaction status from the last ReadyForQuery: 'I' idle, 'T' in a
+	// transaction block, 'E' in a failed transaction block
+	txStatus byte
+	// ID of the open transaction block, 0 when idle
+	transactionID uint64
+	// When the backend completed the previous query
+	lastCompleted time.Time
+}
+
+// pendingQuery is a query the backend hasn't completed yet, or a marker
+// for the Sync that ends an extended-query batch
+type pendingQuery struct {
+	query store.QueryExecuted
+	// A simple Query completes at ReadyForQuery, since one Query message
+	// can hold several statements
+	simple bool
+	sync   bool
+}
+
+// connectionInfo identifies the client connection queries are captured
+// from, using the options of its startup packet
+type connectionInfo struct {
+	id              uint64
+	user            string
+	database        string
+	applicationName string
+	options         map[string]string
+}
+
+func makeConnectionInfo(id uint64, startup *pgwire.StartupMessage) connectionInfo {
+	options, err := pgwire.ParseStartupOptions(startup.Payload)
+	if err != nil {
+		log.Printf("Failed to decode startup options of connection %d: %v", id, err)
+	}
+	database := options["database"]
+	if database == "" {
+		// Postgres defaults the database to the user name
+		database = options["user"]
+	}
+	return connectionInfo{
+		id:              id,
+		user:            options["user"],
+		database:        database,
+		applicationName: options["application_name"],
+		options:         options,
+	}
+}
+
+type statement struct {
+	query         string
+	parameterOIDs []uint32
+}
+
+type portal struct {
+	statement  string
+	parameters []*string
+}
+
+func makeCapture(qs *store.QueryStore, captureParameters bool, conn connectionInfo) *capture {
+	return &capture{
+		queryStore:        qs,
+		captureParameters: captureParameters,
+		conn:              conn,
+		statements:        map[string]*statement{},
+		portals:           map[string]*portal{},
+		txStatus:          pgwire.TxIdle,
+	}
+}
+
+func (c *capture) handleFrontend(msg *pgwire.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	switch msg.Type {
+	case pgwire.QueryMessage:
+		err = c.handleQuery(msg.Payload)
+	case pgwire.ParseMessage:
+		err = c.handleParse(msg.Payload)
+	case pgwire.BindMessage:
+		err = c.handleBind(msg.Payload)
+	case pgwire.DescribeMessage:
+		err = c.handleDescribe(msg.Payload)
+	case pgwire.ExecuteMessage:
+		err = c.handleExecute(msg.Payload)
+	case pgwire.CloseMessage:
+		err = c.handleClose(msg.Payload)
+	case pgwire.SyncMessage:
+		// The backend answers a Sync with ReadyForQuery, which ends
+		// the batch
+		c.pending = append(c.pending, &pendingQuery{sync: true})
+	}
+	if err != nil {
+		log.Printf("Failed to decode %q message: %v", msg.Type, err)
+	}
+}
+
+func (c *capture) handleBackend(msg *pgwire.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	switch msg.Type {
+	case pgwire.ParameterDescriptionMessage:
+		err = c.handleParameterDescription(msg.Payload)
+	case pgwire.DataRowMessage:
+		if p := c.current(); p != nil {
+			p.query.Rows++
+		}
+	case pgwire.CommandCompleteMessage:
+		err = c.handleCommandComplete(msg.Payload)
+	case pgwire.ErrorResponseMessage:
+		err = c.handleErrorResponse(msg.Payload)
+	case pgwire.EmptyQueryResponseMessage, pgwire.PortalSuspendedMessage:
+		c.completeExecute()
+	case pgwire.ReadyForQueryMessage:
+		err = c.handleReadyForQuery(msg.Payload)
+	}
+	if err != nil {
+		log.Printf("Failed to decode %q message: %v", msg.Type, err)
+	}
+}
+
+// newQuery starts a captured query tagged with the connection it ran on
+func (c *capture) newQuery(query string) store.QueryExecuted {
+	return store.QueryExecuted{
+		Query:           query,
+		ConnectionID:    c.conn.id,
+		Database:        c.conn.database,
+		ApplicationName: c.conn.applicationName,
+		StartTime:       time.Now(),
+	}
+}
+
+// current returns the query the backend is answering, if any
+func (c *capture) current() *pendingQuery {
+	if len(c.pending) == 0 || c.pending[0].sync {
+		return nil
+	}
+	return c.pending[0]
+}
+
+func (c *capture) handleCommandComplete(payload []byte) error {
+	tag, err := pgwire.ParseCommandComplete(payload)
+	if err != nil {
+		return err
+	}
+	// A simple Query holding several statements completes each one, the
+	// last tag is the one kept
+	if p := c.current(); p != nil {
+		p.query.CommandTag = tag
+	}
+	c.completeExecute()
+	return nil
+}
+
+func (c *capture) handleErrorResponse(payload []byte) error {
+	e, err := pgwire.ParseErrorResponse(payload)
+	if err != nil {
+		return err
+	}
+	// Errors outside of a query, such as a failed login, have nothing to
+	// attach to
+	if p := c.current(); p != nil {
+		p.query.Error = &store.QueryError{
+			Severity: e.Severity,
+			Code:     e.Code,
+			Message:  e.Message,
+			Detail:   e.Detail,
+			Hint:     e.Hint,
+			Position: e.Position,
+		}
+	}
+	c.completeExecute()
+	return nil
+}
+
+// completeExecute finishes the Execute at the head of the pending queue
+// once the backend has answered it. Simple queries keep going until
+// ReadyForQuery.
+func (c *capture) completeExecute() {
+	p := c.current()
+	if p == nil || p.simple {
+		return
+	}
+	c.pending = c.pending[1:]
+	c.finish(p)
+}
+
+func (c *capture) handleReadyForQuery(payload []byte) error {
+	status, err := pgwire.ParseReadyForQuery(payload)
+	if err != nil {
+		return err
+	}
+	// Describes that failed never get a ParameterDescription, and the
+	// batch they belonged to is over
+	c.describes = nil
+	c.completeBatch()
+
+	// Leaving idle means the batch opened a transaction block, so its
+	// queries and all until the next idle belong to a new transaction
+	if c.txStatus == pgwire.TxIdle && status != pgwire.TxIdle {
+		c.transactionID = nextTransactionID.Add(1)
+	}
+	c.flush(status)
+	if status == pgwire.TxIdle {
+		c.transactionID = 0
+	}
+	c.txStatus = status
+	return nil
+}
+
+// close records queries still held when the connection ends. A
+// transaction block left open keeps its ID and shows up as open.
+func (c *capture) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush(c.txStatus)
+}
+
+// flush records the completed queries under the current transaction, with
+// the transaction status their batch ended in
+func (c *capture) flush(status byte) {
+	for _, q := range c.completed {
+		q.TransactionID = c.transactionID
+		q.TransactionStatus = string(status)
+		metrics.QueriesTotal.Inc(q.Command())
+		metrics.QueryDuration.ObserveDuration(q.Duration)
+		if q.Error != nil {
+			metrics.QueryErrorsTotal.Inc(q.Error.Code)
+		}
+		c.queryStore.AddQuery(q)
+	}
+	c.completed = nil
+}
+
+// completeBatch handles ReadyForQuery, which ends either a simple Query or
+// an extended-query batch up to its Sync. Executes still pending were
+// skipped by the backend after an error and never ran.
+func (c *capture) completeBatch() {
+	for len(c.pending) > 0 {
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		if p.simple {
+			c.finish(p)
+		}
+		if p.simple || p.sync {
+			return
+		}
+	}
+}
+
+// finish completes a query with its timing. The backend answers queries in
+// order, so a pipelined query only starts running once the one ahead of it
+// has completed, and the time it was queued isn't counted.
+func (c *capture) finish(p *pendingQuery) {
+	p.query.EndTime = time.Now()
+	start := p.query.StartTime
+	if c.lastCompleted.After(start) {
+		start = c.lastCompleted
+	}
+	p.query.Duration = p.query.EndTime.Sub(start)
+	c.lastCompleted = p.query.EndTime
+	c.completed = append(c.completed, p.query)
+}
+
+func (c *capture) handleQuery(payload []byte) error {
+	query, err := pgwire.ParseQuery(payload)
+	if err != nil {
+		return err
+	}
+	c.pending = append(c.pending, &pendingQuery{
+		query:  c.newQuery(query),
+		simple: true,
+	})
+	return nil
+}
+
+func (c *capture) handleParse(payload []byte) error {
+	parse, err := pgwire.ParseParse(payload)
+	if err != nil {
+		return err
+	}
+	c.statements[parse.Name] = &statement{
+		query:         parse.Query,
+		parameterOIDs: parse.ParameterOIDs,
+	}
+	return nil
+}
+
+func (c *capture) handleBind(payload []byte) error {
+	bind, err := pgwire.ParseBind(payload)
+	if err != nil {
+		return err
+	}
+	p := &portal{
+		statement: bind.Statement,
+	}
+	if c.captureParameters {
+		var oids []uint32
+		if s, ok := c.statements[bind.Statement]; ok {
+			oids = s.parameterOIDs
+		}
+		p.parameters = make([]*string, len(bind.Parameters))
+		for i, value := range bind.Parameters {
+			if value == nil {
+				continue
+			}
+			var oid uint32
+			if i < len(oids) {
+				oid = oids[i]
+			}
+			decoded := pgwire.DecodeParameter(value, bind.ParameterFormat(i), oid)
+			p.parameters[i] = &decoded
+		}
+	}
+	c.portals[bind.Portal] = p
+	return nil
+}
+
+func (c *capture) handleDescribe(payload []byte) error {
+	describe, err := pgwire.ParseDescribe(payload)
+	if err != nil {
+		return err
+	}
+	if describe.Kind == 'S' {
+		c.describes = append(c.describes, describe.Name)
+	}
+	return nil
+}
+
+func (c *capture) handleParameterDescription(payload []byte) error {
+	oids, err := pgwire.ParseParameterDescription(payload)
+	if err != nil {
+		return err
+	}
+	if len(c.describes) == 0 {
+		return nil
+	}
+	name := c.describes[0]
+	c.describes = c.describes[1:]
+	if s, ok := c.statements[name]; ok {
+		s.parameterOIDs = oids
+	}
+	return nil
+}
+
+func (c *capture) handleExecute(payload []byte) error {
+	execute, err := pgwire.ParseExecute(payload)
+	if err != nil {
+		return err
+	}
+	p, ok := c.portals[execute.Portal]
+	if !ok {
+		log.Printf("Execute for unknown portal %q", execute.Portal)
+		return nil
+	}
+	s, ok := c.statements[p.statement]
+	if !ok {
+		log.Printf("Execute for unknown prepared statement %q", p.statement)
+		return nil
+	}
+	q := c.newQuery(s.query)
+	q.StatementName = p.statement
+	q.Parameters = p.parameters
+	c.pending = append(c.pending, &pendingQuery{query: q})
+	return nil
+}
+
+func (c *capture) handleClose(payload []byte) error {
+	closeMsg, err := pgwire.ParseClose(payload)
+	if err != nil {
+		return err
+	}
+	switch closeMsg.Kind {
+	case 'S':
+		delete(c.statements, closeMsg.Name)
+	case 'P':
+		delete(c.portals, closeMsg.Name)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/droptableifexists/recon/sql-proxy/pgwire"
+	"github.com/droptableifexists/recon/sql-proxy/store"
+)
+
+// payload encodes a message body from strings, written null terminated,
+// int16 and int32 values, and raw bytes
+func payload(parts ...any) []byte {
+	var b []byte
+	for _, part := range parts {
+		switch v := part.(type) {
+		case string:
+			b = append(append(b, v...), 0)
+		case int16:
+			b = binary.BigEndian.AppendUint16(b, uint16(v))
+		case int32:
+			b = binary.BigEndian.AppendUint32(b, uint32(v))
+		case []byte:
+			b = append(b, v...)
+		default:
+			panic("unsupported payload part")
+		}
+	}
+	return b
+}
+
+// message is a protocol message and the direction it travels in
+type message struct {
+	frontend bool
+	pgwire.Message
+}
+
+func frontend(typ byte, parts ...any) message {
+	return message{true, pgwire.Message{Type: typ, Payload: payload(parts...)}}
+}
+
+func backend(typ byte, parts ...any) message {
+	return message{false, pgwire.Message{Type: typ, Payload: payload(parts...)}}
+}
+
+func query(sql string) message { return frontend(pgwire.QueryMessage, sql) }
+func syncBatch() message       { return frontend(pgwire.SyncMessage) }
+
+// parse prepares sql as statement name, with int4 parameters
+func parse(name, sql string, parameters int) message {
+	parts := []any{name, sql, int16(parameters)}
+	for i := 0; i < parameters; i++ {
+		parts = append(parts, int32(pgwire.Int4OID))
+	}
+	return frontend(pgwire.ParseMessage, parts...)
+}
+
+// bind binds statement to the unnamed portal with int4 parameters in
+// binary format
+func bind(statement string, values ...int32) message {
+	parts := []any{"", statement, int16(1), int16(pgwire.BinaryFormat), int16(len(values))}
+	for _, v := range values {
+		parts = append(parts, int32(4), v)
+	}
+	return frontend(pgwire.BindMessage, append(parts, int16(0))...)
+}
+
+func execute() message { return frontend(pgwire.ExecuteMessage, "", int32(0)) }
+
+func dataRow() message { return backend(pgwire.DataRowMessage, int16(1), int32(1), []byte("1")) }
+func commandComplete(tag string) message {
+	return backend(pgwire.CommandCompleteMessage, tag)
+}
+func errorResponse(code string) message {
+	return backend(pgwire.ErrorResponseMessage, []byte{'S'}, "ERROR", []byte{'C'}, code, []byte{'M'}, "failed", []byte{0})
+}
+func readyForQuery(status byte) message {
+	return backend(pgwire.ReadyForQueryMessage, []byte{status})
+}
+
+// replay feeds messages to a capture and returns the queries it stored
+func replay(t *testing.T, messages ...message) []store.QueryExecuted {
+	t.Helper()
+	qs, err := store.MakeQueryStore(0, store.PolicyRing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := makeCapture(qs, true, connectionInfo{id: 1, database: "shop"})
+	for _, m := range messages {
+		if m.frontend {
+			c.handleFrontend(&m.Message)
+		} else {
+			c.handleBackend(&m.Message)
+		}
+	}
+	return qs.ListQueries()
+}
+
+func parameters(q store.QueryExecuted) []string {
+	var values []string
+	for _, p := range q.Parameters {
+		if p == nil {
+			values = append(values, "NULL")
+			continue
+		}
+		values = append(values, *p)
+	}
+	return values
+}
+
+func TestCaptureSimpleQuery(t *testing.T) {
+	got := replay(t,
+		query("SELECT 1"),
+		dataRow(),
+		commandComplete("SELECT 1"),
+		readyForQuery(pgwire.TxIdle),
+		// Several statements in one Query are captured as one query with
+		// the last tag
+		query("INSERT INTO t VALUES (1); SELECT * FROM t"),
+		commandComplete("INSERT 0 1"),
+		dataRow(),
+		dataRow(),
+		commandComplete("SELECT 2"),
+		readyForQuery(pgwire.TxIdle),
+	)
+	if len(got) != 2 {
+		t.Fatalf("captured %d queries, want 2", len(got))
+	}
+	want := []struct {
+		query string
+		tag   string
+		rows  int64
+	}{
+		{"SELECT 1", "SELECT 1", 1},
+		{"INSERT INTO t VALUES (1); SELECT * FROM t", "SELECT 2", 2},
+	}
+	for i, w := range want {
+		q := got[i]
+		if q.Query != w.query || q.CommandTag != w.tag || q.Rows != w.rows {
+			t.Errorf("query %d is %q tagged %q with %d rows, want %q tagged %q with %d rows", i, q.Query, q.CommandTag, q.Rows, w.query, w.tag, w.rows)
+		}
+		if q.ConnectionID != 1 || q.Database != "shop" || q.TransactionID != 0 || q.Error != nil {
+			t.Errorf("query %d: %+v", i, q)
+		}
+	}
+}
+
+func TestCapturePipelinedExtendedQuery(t *testing.T) {
+	got := replay(t,
+		// Everything up to the Sync is sent before the backend answers
+		parse("s1", "SELECT * FROM t WHERE id = $1", 1),
+		bind("s1", 7),
+		execute(),
+		bind("s1", -8),
+		execute(),
+		parse("", "UPDATE t SET a = $1", 1),
+		bind("", 9),
+		execute(),
+		syncBatch(),
+		backend('1'),
+		backend('2'),
+		dataRow(),
+		commandComplete("SELECT 1"),
+		backend('2'),
+		commandComplete("SELECT 0"),
+		backend('1'),
+		backend('2'),
+		commandComplete("UPDATE 3"),
+		readyForQuery(pgwire.TxIdle),
+	)
+	want := []struct {
+		query     string
+		statement string
+		parameter string
+		tag       string
+		rows      int64
+	}{
+		{"SELECT * FROM t WHERE id = $1", "s1", "7", "SELECT 1", 1},
+		{"SELECT * FROM t WHERE id = $1", "s1", "-8", "SELECT 0", 0},
+		{"UPDATE t SET a = $1", "", "9", "UPDATE 3", 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("captured %d queries, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		q := got[i]
+		if q.Query != w.query || q.StatementName != w.statement || q.CommandTag != w.tag || q.Rows != w.rows {
+			t.Errorf("query %d is %q of statement %q tagged %q with %d rows, want %q of %q tagged %q with %d rows",
+				i, q.Query, q.StatementName, q.CommandTag, q.Rows, w.query, w.statement, w.tag, w.rows)
+		}
+		if p := parameters(q); len(p) != 1 || p[0] != w.parameter {
+			t.Errorf("query %d has parameters %v, want [%s]", i, p, w.parameter)
+		}
+		if q.Error != nil {
+			t.Errorf("query %d has error %+v", i, q.Error)
+		}
+	}
+}
+
+func TestCaptureHeldUntilReadyForQuery(t *testing.T) {
+	got := replay(t,
+		parse("", "SELECT 1", 0),
+		bind(""),
+		execute(),
+		syncBatch(),
+		commandComplete("SELECT 1"),
+	)
+	if len(got) != 0 {
+		t.Errorf("captured %d queries before ReadyForQuery, want them held", len(got))
+	}
+}
+
+func TestCaptureErrorSkipsRestOfBatch(t *testing.T) {
+	got := replay(t,
+		parse("ins", "INSERT INTO t VALUES ($1)", 1),
+		bind("ins", 1),
+		execute(),
+		bind("ins", 2),
+		execute(),
+		bind("ins", 3),
+		execute(),
+		syncBatch(),
+		// The backend skips the third Execute after the error, up to
+		// the Sync
+		commandComplete("INSERT 0 1"),
+		errorResponse("23505"),
+		readyForQuery(pgwire.TxIdle),
+		// The next batch is matched with its own messages
+		query("SELECT 2"),
+		dataRow(),
+		commandComplete("SELECT 1"),
+		readyForQuery(pgwire.TxIdle),
+	)
+	if len(got) != 3 {
+		t.Fatalf("captured %d queries, want 3", len(got))
+	}
+	if q := got[0]; q.CommandTag != "INSERT 0 1" || q.Error != nil || parameters(q)[0] != "1" {
+		t.Errorf("first query: %+v", q)
+	}
+	if q := got[1]; q.CommandTag != "" || q.Error == nil || q.Error.Code != "23505" || parameters(q)[0] != "2" {
+		t.Errorf("failed query: %+v", q)
+	}
+	if q := got[2]; q.Query != "SELECT 2" || q.CommandTag != "SELECT 1" || q.Rows != 1 || q.Error != nil {
+		t.Errorf("query after the failed batch: %+v", q)
+	}
+}
+
+func TestCaptureTransactionID(t *testing.T) {
+	got := replay(t,
+		query("BEGIN"),
+		commandComplete("BEGIN"),
+		readyForQuery(pgwire.TxActive),
+		query("UPDATE t SET a = 1"),
+		commandComplete("UPDATE 1"),
+		readyForQuery(pgwire.TxActive),
+		query("COMMIT"),
+		commandComplete("COMMIT"),
+		readyForQuery(pgwire.TxIdle),
+		query("SELECT 1"),
+		commandComplete("SELECT 1"),
+		readyForQuery(pgwire.TxIdle),
+	)
+	if len(got) != 4 {
+		t.Fatalf("captured %d queries, want 4", len(got))
+	}
+	id := got[0].TransactionID
+	if id == 0 || got[1].TransactionID != id || got[2].TransactionID != id {
+		t.Errorf("transaction block has IDs %d, %d and %d, want one ID", id, got[1].TransactionID, got[2].TransactionID)
+	}
+	if got[3].TransactionID != 0 {
+		t.Errorf("query after COMMIT has transaction ID %d, want 0", got[3].TransactionID)
+	}
+}
+
+func TestCaptureTransactionOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []message
+		want     string
+	}{
+		{"commit", []message{
+			query("BEGIN"), commandComplete("BEGIN"), readyForQuery(pgwire.TxActive),
+			query("COMMIT"), commandComplete("COMMIT"), readyForQuery(pgwire.TxIdle),
+		}, store.OutcomeCommit},
+		{"rollback", []message{
+			query("BEGIN"), commandComplete("BEGIN"), readyForQuery(pgwire.TxActive),
+			query("ROLLBACK"), commandComplete("ROLLBACK"), readyForQuery(pgwire.TxIdle),
+		}, store.OutcomeRollback},
+		// Postgres answers the COMMIT of a failed block with ROLLBACK
+		{"failed commit", []message{
+			query("BEGIN"), commandComplete("BEGIN"), readyForQuery(pgwire.TxActive),
+			query("INSERT INTO t VALUES (1)"), errorResponse("23505"), readyForQuery(pgwire.TxFailed),
+			query("COMMIT"), commandComplete("ROLLBACK"), readyForQuery(pgwire.TxIdle),
+		}, store.OutcomeRollback},
+		// Rolling back to a savepoint is tagged ROLLBACK too, but the
+		// block goes on
+		{"rollback to savepoint", []message{
+			query("BEGIN"), commandComplete("BEGIN"), readyForQuery(pgwire.TxActive),
+			query("SAVEPOINT s"), commandComplete("SAVEPOINT"), readyForQuery(pgwire.TxActive),
+			query("INSERT INTO t VALUES (1)"), errorResponse("23505"), readyForQuery(pgwire.TxFailed),
+			query("ROLLBACK TO SAVEPOINT s"), commandComplete("ROLLBACK"), readyForQuery(pgwire.TxActive),
+		}, store.OutcomeOpen},
+		{"savepoint then commit", []message{
+			query("BEGIN; SAVEPOINT s"), commandComplete("BEGIN"), commandComplete("SAVEPOINT"), readyForQuery(pgwire.TxActive),
+			query("ROLLBACK TO SAVEPOINT s"), commandComplete("ROLLBACK"), readyForQuery(pgwire.TxActive),
+			query("COMMIT"), commandComplete("COMMIT"), readyForQuery(pgwire.TxIdle),
+		}, store.OutcomeCommit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transactions := store.GroupTransactions(replay(t, tt.messages...))
+			if len(transactions) != 1 {
+				t.Fatalf("got %d transactions, want 1", len(transactions))
+			}
+			if got := transactions[0].Outcome; got != tt.want {
+				t.Errorf("outcome is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
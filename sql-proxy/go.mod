@@ -1,3 +1,7 @@
 module github.com/droptableifexists/recon/sql-proxy
 
 go 1.21.3
+
+require go.etcd.io/bbolt v1.3.10
+
+require golang.org/x/sys v0.4.0 // indirect
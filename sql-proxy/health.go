@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/droptableifexists/recon/sql-proxy/pgwire"
+)
+
+// How /readyz probes the backend
+const (
+	// Connect over TCP
+	probeTCP = "tcp"
+	// Also send an SSLRequest and wait for the one byte answer, which only
+	// a Postgres server gives
+	probeHandshake = "handshake"
+)
+
+// How long a readiness probe waits for the backend
+const probeTimeout = 2 * time.Second
+
+// checkReady reports why the proxy can't serve clients yet, or nil once
+// it listens and the backend answers the configured probe
+func (p *proxy) checkReady() error {
+	if !p.listening.Load() {
+		return fmt.Errorf("proxy is not listening yet")
+	}
+	conn, err := net.DialTimeout("tcp", p.backendAddr, probeTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to backend: %v", err)
+	}
+	defer conn.Close()
+	if p.readinessProbe != probeHandshake {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+	request := pgwire.StartupMessage{Code: pgwire.SSLRequestCode}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return fmt.Errorf("failed to send SSLRequest to backend: %v", err)
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return fmt.Errorf("backend did not answer SSLRequest: %v", err)
+	}
+	if answer[0] != 'S' && answer[0] != 'N' {
+		return fmt.Errorf("backend answered SSLRequest with %q", answer[0])
+	}
+	return nil
+}
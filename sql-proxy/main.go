@@ -1,90 +1,292 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/droptableifexists/recon/sql-proxy/api"
+	"github.com/droptableifexists/recon/sql-proxy/metrics"
+	"github.com/droptableifexists/recon/sql-proxy/pgwire"
 	"github.com/droptableifexists/recon/sql-proxy/store"
 )
 
+// Sources of the IDs given to client connections and transaction blocks
+var nextConnectionID, nextTransactionID atomic.Uint64
+
+// proxy accepts client connections and forwards them to the backend,
+// capturing the queries that pass through
+type proxy struct {
+	backendAddr       string
+	queryStore        *store.QueryStore
+	captureParameters bool
+	// Presented to clients that send an SSLRequest, nil to decline TLS
+	clientTLS *tls.Config
+	// Used to connect to the backend unless backendSSLMode is disable
+	backendSSLMode string
+	backendTLS     *tls.Config
+	// Set once the listener is bound, and how /readyz probes the backend
+	listening      atomic.Bool
+	readinessProbe string
+}
+
 func main() {
 	// Get configuration from environment variables with defaults
 	listenPort := getEnv("LISTEN_PORT", "5433")
 	backendHost := getEnv("BACKEND_HOST", "postgres")
 	backendPort := getEnv("BACKEND_PORT", "5432")
+	// Bind parameter values can hold sensitive data, so suites can opt out
+	captureParameters := getEnv("CAPTURE_PARAMETERS", "true") != "false"
+	backendSSLMode := getEnv("BACKEND_SSLMODE", sslModeDisable)
+	// Bound the store so a long suite can't exhaust memory, 0 for no limit
+	storeCapacity, err := strconv.Atoi(getEnv("QUERY_STORE_CAPACITY", "100000"))
+	if err != nil {
+		log.Fatalf("Invalid QUERY_STORE_CAPACITY: %v", err)
+	}
+	storePolicy := getEnv("QUERY_STORE_POLICY", store.PolicyRing)
+	// Persist queries so a capture survives restarts
+	storeBackend := getEnv("QUERY_STORE_BACKEND", store.BackendMemory)
+	storePath := os.Getenv("QUERY_STORE_PATH")
+	readinessProbe := getEnv("READINESS_PROBE", probeTCP)
+	if readinessProbe != probeTCP && readinessProbe != probeHandshake {
+		log.Fatalf("Invalid READINESS_PROBE %q, expected %s or %s", readinessProbe, probeTCP, probeHandshake)
+	}
+
+	clientTLS, err := loadClientTLSConfig(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to configure client TLS: %v", err)
+	}
+	backendTLS, err := loadBackendTLSConfig(backendSSLMode, os.Getenv("BACKEND_SSLROOTCERT"), backendHost)
+	if err != nil {
+		log.Fatalf("Failed to configure backend TLS: %v", err)
+	}
 
 	// The address on which our proxy listens
 	listenAddr := ":" + listenPort
 	// The actual Postgres server address
 	backendAddr := backendHost + ":" + backendPort
 
-	qs := store.MakeQueryStore()
-	a := api.MakeQueriesExecutedAPI(qs)
+	backend, err := store.OpenBackend(storeBackend, storePath)
+	if err != nil {
+		log.Fatalf("Failed to open query store backend: %v", err)
+	}
+	qs, err := store.MakeQueryStore(storeCapacity, storePolicy, backend)
+	if err != nil {
+		log.Fatalf("Failed to create query store: %v", err)
+	}
+
+	p := &proxy{
+		backendAddr:       backendAddr,
+		queryStore:        qs,
+		captureParameters: captureParameters,
+		clientTLS:         clientTLS,
+		backendSSLMode:    backendSSLMode,
+		backendTLS:        backendTLS,
+		readinessProbe:    readinessProbe,
+	}
+	a := api.MakeQueriesExecutedAPI(qs, p.checkReady)
 	go a.RunApi()
+
 	// Listen for incoming client connections
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
-	defer listener.Close()
+	p.listening.Store(true)
 	fmt.Printf("Proxy listening on %s, forwarding to %s\n", listenAddr, backendAddr)
 
+	// Stop accepting on SIGINT or SIGTERM, as sent by docker stop, so the
+	// queued queries are persisted before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
 	// Handle incoming client connections
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
-		go handleClient(clientConn, backendAddr, qs)
+		go p.handleClient(clientConn)
+	}
+
+	log.Printf("Shutting down")
+	if err := qs.Close(); err != nil {
+		log.Printf("Failed to close query store: %v", err)
 	}
 }
 
-func handleClient(clientConn net.Conn, backendAddr string, qs *store.QueryStore) {
-	defer clientConn.Close()
+func (p *proxy) handleClient(clientConn net.Conn) {
+	metrics.ActiveConnections.Inc()
+	defer func() {
+		clientConn.Close()
+		metrics.ActiveConnections.Dec()
+	}()
+
+	// The proxy answers SSLRequest itself so it can see the queries even
+	// when the client encrypts, which may swap clientConn for a TLS one
+	clientConn, client, startup, err := p.readStartup(clientConn)
+	if err != nil {
+		log.Printf("Error during startup: %v", err)
+		return
+	}
 
 	// Connect to the backend (Postgres server)
-	backendConn, err := net.Dial("tcp", backendAddr)
+	backendConn, err := p.dialBackend()
 	if err != nil {
+		metrics.BackendDialFailuresTotal.Inc()
 		log.Printf("Failed to connect to backend: %v", err)
 		return
 	}
 	defer backendConn.Close()
 
-	// Proxy data from client to backend
-	go proxyData(clientConn, backendConn, qs)
+	if _, err := backendConn.Write(startup.Bytes()); err != nil {
+		log.Printf("Failed to forward startup packet: %v", err)
+		return
+	}
+	if startup.Code == pgwire.CancelRequestCode {
+		// The backend closes the connection without answering
+		return
+	}
+	backend := pgwire.MakeReader(backendConn)
+
+	conn := makeConnectionInfo(nextConnectionID.Add(1), startup)
+	log.Printf("Connection %d opened with startup options %v", conn.id, conn.options)
+
+	c := makeCapture(p.queryStore, p.captureParameters, conn)
+	// Proxy data from client to backend. A client that disconnects without
+	// a Terminate leaves the backend waiting, so pass the EOF on for the
+	// backend to close its side too.
+	go func() {
+		proxyData(client, backendConn, c.handleFrontend, metrics.DirectionFrontend)
+		closeWrite(backendConn)
+	}()
 	// Proxy data from backend to client
-	proxyData(backendConn, clientConn, qs)
+	proxyData(backend, clientConn, c.handleBackend, metrics.DirectionBackend)
+	c.close()
+}
+
+// readStartup reads startup packets until the client sends a
+// StartupMessage or CancelRequest. An SSLRequest is accepted when the
+// proxy has a certificate, in which case the connection and reader
+// returned are the TLS ones.
+func (p *proxy) readStartup(clientConn net.Conn) (net.Conn, *pgwire.Reader, *pgwire.StartupMessage, error) {
+	client := pgwire.MakeReader(clientConn)
+	for {
+		startup, err := client.ReadStartupMessage()
+		if err != nil {
+			return clientConn, nil, nil, err
+		}
+
+		switch startup.Code {
+		case pgwire.SSLRequestCode:
+			_, encrypted := clientConn.(*tls.Conn)
+			if p.clientTLS == nil || encrypted {
+				if _, err := clientConn.Write([]byte{'N'}); err != nil {
+					return clientConn, nil, nil, err
+				}
+				continue
+			}
+			if _, err := clientConn.Write([]byte{'S'}); err != nil {
+				return clientConn, nil, nil, err
+			}
+			tlsConn := tls.Server(clientConn, p.clientTLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return clientConn, nil, nil, fmt.Errorf("TLS handshake with client failed: %v", err)
+			}
+			clientConn = tlsConn
+			client = pgwire.MakeReader(clientConn)
+		case pgwire.GSSENCRequestCode:
+			if _, err := clientConn.Write([]byte{'N'}); err != nil {
+				return clientConn, nil, nil, err
+			}
+		default:
+			return clientConn, client, startup, nil
+		}
+	}
+}
+
+// dialBackend connects to the backend, negotiating TLS according to the
+// configured sslmode
+func (p *proxy) dialBackend() (net.Conn, error) {
+	conn, err := net.Dial("tcp", p.backendAddr)
+	if err != nil {
+		return nil, err
+	}
+	if p.backendTLS == nil {
+		return conn, nil
+	}
+
+	request := pgwire.StartupMessage{Code: pgwire.SSLRequestCode}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The server answers with a single unframed byte
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		if p.backendSSLMode == sslModePrefer {
+			return conn, nil
+		}
+		conn.Close()
+		return nil, fmt.Errorf("backend does not support TLS")
+	}
+
+	tlsConn := tls.Client(conn, p.backendTLS)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with backend failed: %v", err)
+	}
+	return tlsConn, nil
 }
 
-// proxyData forwards data between two connections
-func proxyData(src net.Conn, dst net.Conn, qs *store.QueryStore) {
-	buffer := make([]byte, 4096)
+// proxyData forwards messages from src to dst unchanged, handing each
+// complete message to handle first and counting the bytes under direction
+func proxyData(src *pgwire.Reader, dst net.Conn, handle func(*pgwire.Message), direction string) {
+	w := bufio.NewWriter(dst)
+	proxied := metrics.BytesProxiedTotal.With(direction)
 	for {
-		// Read data from source
-		n, err := src.Read(buffer)
+		// Read the next message from source
+		msg, err := src.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from source: %v", err)
+			if err != io.EOF {
+				log.Printf("Error reading from source: %v", err)
+			}
+			w.Flush()
 			return
 		}
 
-		if buffer[0] == 'Q' {
-			queryBytes := bytes.Trim(buffer[1:n], "\x00")
-			rawDataString := string(queryBytes)
-			fmt.Print("\n Query Passing thru: \n")
-			fmt.Print(rawDataString[1:])
-			qs.AddQuery(store.QueryExecuted{
-				Query: rawDataString[1:],
-			})
-			fmt.Print("\n End")
+		if handle != nil {
+			handle(msg)
 		}
 
-		// Write data to destination
-		_, err = dst.Write(buffer[:n])
+		// Write data to destination, flushing once nothing more is
+		// waiting so small messages are batched without adding latency
+		n, err := w.Write(msg.Bytes())
+		proxied.Add(uint64(n))
+		if err == nil && src.Buffered() == 0 {
+			err = w.Flush()
+		}
 		if err != nil {
 			log.Printf("Error writing to destination: %v", err)
 			return
@@ -92,6 +294,16 @@ func proxyData(src net.Conn, dst net.Conn, qs *store.QueryStore) {
 	}
 }
 
+// closeWrite shuts down the writing side of conn, closing it entirely when
+// that is not supported
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
 // Helper function to get environment variables with defaults
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -0,0 +1,212 @@
+// Package metrics keeps the proxy's counters and writes them in the
+// Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics exposed by the proxy
+var (
+	QueriesTotal = MakeCounterVec("sql_proxy_queries_total",
+		"Queries captured, by command type.", "command")
+	QueryErrorsTotal = MakeCounterVec("sql_proxy_query_errors_total",
+		"Queries the backend answered with an ErrorResponse, by SQLSTATE.", "sqlstate")
+	ActiveConnections = MakeGauge("sql_proxy_active_connections",
+		"Client connections currently open.")
+	BackendDialFailuresTotal = MakeCounter("sql_proxy_backend_dial_failures_total",
+		"Failed attempts to connect to the backend.")
+	BytesProxiedTotal = MakeCounterVec("sql_proxy_bytes_proxied_total",
+		"Bytes forwarded, by direction: frontend from client to backend, backend from backend to client.", "direction")
+	UnpersistedQueriesTotal = MakeCounter("sql_proxy_unpersisted_queries_total",
+		"Queries kept in memory only because the storage backend fell behind.")
+	QueryDuration = MakeHistogram("sql_proxy_query_duration_seconds",
+		"Time from the client's Query or Execute to the backend's answer.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+)
+
+// Directions of BytesProxiedTotal
+const (
+	DirectionFrontend = "frontend"
+	DirectionBackend  = "backend"
+)
+
+// metric is anything that can write its samples
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+
+// WriteTo writes every metric in the text exposition format
+func WriteTo(w io.Writer) {
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	name, help string
+	value      atomic.Uint64
+}
+
+func MakeCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	registry = append(registry, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value.Load())
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func MakeGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	registry = append(registry, g)
+	return g
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.value.Load())
+}
+
+// CounterVec is a set of counters told apart by the value of one label
+type CounterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	counters          map[string]*atomic.Uint64
+}
+
+func MakeCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{name: name, help: help, label: label, counters: map[string]*atomic.Uint64{}}
+	registry = append(registry, v)
+	return v
+}
+
+// With returns the counter for a label value, so hot paths can look it up
+// once
+func (v *CounterVec) With(value string) *atomic.Uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = &atomic.Uint64{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) Inc(value string) {
+	v.With(value).Add(1)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mu.Lock()
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", v.name, v.label, escapeLabel(value), v.With(value).Load())
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name, help string
+	bounds     []float64
+	mu         sync.Mutex
+	// Observations per bucket, the last one above every bound
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func MakeHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	registry = append(registry, h)
+	return h
+}
+
+// ObserveDuration records d in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value as the exposition format requires
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
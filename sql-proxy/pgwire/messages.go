@@ -0,0 +1,334 @@
+package pgwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Frontend message types
+const (
+	QueryMessage    = 'Q'
+	ParseMessage    = 'P'
+	BindMessage     = 'B'
+	ExecuteMessage  = 'E'
+	SyncMessage     = 'S'
+	CloseMessage    = 'C'
+	DescribeMessage = 'D'
+)
+
+// Transaction status reported by ReadyForQuery
+const (
+	TxIdle   = 'I'
+	TxActive = 'T'
+	TxFailed = 'E'
+)
+
+// Backend message types
+const (
+	ParameterDescriptionMessage = 't'
+	ReadyForQueryMessage        = 'Z'
+	CommandCompleteMessage      = 'C'
+	DataRowMessage              = 'D'
+	EmptyQueryResponseMessage   = 'I'
+	PortalSuspendedMessage      = 's'
+	ErrorResponseMessage        = 'E'
+)
+
+// Parse creates a prepared statement from SQL text
+type Parse struct {
+	Name          string
+	Query         string
+	ParameterOIDs []uint32
+}
+
+// Bind creates a portal from a prepared statement and parameter values.
+// A nil parameter is SQL NULL.
+type Bind struct {
+	Portal           string
+	Statement        string
+	ParameterFormats []int16
+	Parameters       [][]byte
+	ResultFormats    []int16
+}
+
+// Execute runs a portal
+type Execute struct {
+	Portal  string
+	MaxRows uint32
+}
+
+// Close destroys a prepared statement ('S') or portal ('P')
+type Close struct {
+	Kind byte
+	Name string
+}
+
+// Describe asks for a description of a prepared statement ('S') or
+// portal ('P')
+type Describe struct {
+	Kind byte
+	Name string
+}
+
+// ParseStartupOptions decodes the name/value pairs of a StartupMessage,
+// such as user, database and application_name
+func ParseStartupOptions(payload []byte) (map[string]string, error) {
+	options := map[string]string{}
+	for len(payload) > 0 && payload[0] != 0 {
+		var name, value string
+		var err error
+		if name, payload, err = readString(payload); err != nil {
+			return options, err
+		}
+		if value, payload, err = readString(payload); err != nil {
+			return options, err
+		}
+		options[name] = value
+	}
+	return options, nil
+}
+
+// ParseQuery decodes the SQL text of a simple Query message
+func ParseQuery(payload []byte) (string, error) {
+	query, _, err := readString(payload)
+	return query, err
+}
+
+// ParseParse decodes a Parse message
+func ParseParse(payload []byte) (*Parse, error) {
+	var p Parse
+	var err error
+	if p.Name, payload, err = readString(payload); err != nil {
+		return nil, err
+	}
+	if p.Query, payload, err = readString(payload); err != nil {
+		return nil, err
+	}
+	if p.ParameterOIDs, err = readOIDs(payload); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ParseBind decodes a Bind message
+func ParseBind(payload []byte) (*Bind, error) {
+	var b Bind
+	var err error
+	if b.Portal, payload, err = readString(payload); err != nil {
+		return nil, err
+	}
+	if b.Statement, payload, err = readString(payload); err != nil {
+		return nil, err
+	}
+	if b.ParameterFormats, payload, err = readInt16s(payload); err != nil {
+		return nil, err
+	}
+	count, payload, err := readCount(payload)
+	if err != nil {
+		return nil, err
+	}
+	b.Parameters = make([][]byte, count)
+	for i := range b.Parameters {
+		var length int32
+		if length, payload, err = readInt32(payload); err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			continue
+		}
+		if int(length) > len(payload) {
+			return nil, fmt.Errorf("parameter %d overruns message", i+1)
+		}
+		b.Parameters[i] = payload[:length]
+		payload = payload[length:]
+	}
+	if b.ResultFormats, _, err = readInt16s(payload); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// ParseExecute decodes an Execute message
+func ParseExecute(payload []byte) (*Execute, error) {
+	portal, payload, err := readString(payload)
+	if err != nil {
+		return nil, err
+	}
+	maxRows, _, err := readInt32(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Execute{
+		Portal:  portal,
+		MaxRows: uint32(maxRows),
+	}, nil
+}
+
+// ParseClose decodes a frontend Close message
+func ParseClose(payload []byte) (*Close, error) {
+	kind, name, err := readTarget(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Close{
+		Kind: kind,
+		Name: name,
+	}, nil
+}
+
+// ParseDescribe decodes a Describe message
+func ParseDescribe(payload []byte) (*Describe, error) {
+	kind, name, err := readTarget(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Describe{
+		Kind: kind,
+		Name: name,
+	}, nil
+}
+
+// ParseParameterDescription decodes the parameter type OIDs the backend
+// sends in response to describing a prepared statement
+func ParseParameterDescription(payload []byte) ([]uint32, error) {
+	return readOIDs(payload)
+}
+
+// ErrorResponse holds the fields of a backend ErrorResponse
+type ErrorResponse struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+	// 1-based character index into the query string, 0 when absent
+	Position int
+}
+
+// ParseErrorResponse decodes the fields of an ErrorResponse message that
+// are useful for reporting, skipping the rest
+func ParseErrorResponse(payload []byte) (*ErrorResponse, error) {
+	var e ErrorResponse
+	for len(payload) > 0 && payload[0] != 0 {
+		field := payload[0]
+		var value string
+		var err error
+		if value, payload, err = readString(payload[1:]); err != nil {
+			return nil, err
+		}
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		case 'H':
+			e.Hint = value
+		case 'P':
+			e.Position, _ = strconv.Atoi(value)
+		}
+	}
+	return &e, nil
+}
+
+// ParseReadyForQuery decodes the transaction status of a ReadyForQuery
+// message
+func ParseReadyForQuery(payload []byte) (byte, error) {
+	if len(payload) != 1 {
+		return 0, fmt.Errorf("invalid ReadyForQuery length %d", len(payload))
+	}
+	return payload[0], nil
+}
+
+// ParseCommandComplete decodes the command tag of a CommandComplete
+// message, such as "SELECT 120" or "UPDATE 3"
+func ParseCommandComplete(payload []byte) (string, error) {
+	tag, _, err := readString(payload)
+	return tag, err
+}
+
+// readTarget reads the statement-or-portal kind byte and name shared by
+// Close and Describe
+func readTarget(payload []byte) (byte, string, error) {
+	if len(payload) < 1 {
+		return 0, "", fmt.Errorf("empty message")
+	}
+	name, _, err := readString(payload[1:])
+	if err != nil {
+		return 0, "", err
+	}
+	return payload[0], name, nil
+}
+
+// readString reads a null-terminated string and returns the rest of the
+// buffer
+func readString(b []byte) (string, []byte, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, fmt.Errorf("unterminated string")
+	}
+	return string(b[:i]), b[i+1:], nil
+}
+
+func readInt16(b []byte) (int16, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, fmt.Errorf("message too short")
+	}
+	return int16(binary.BigEndian.Uint16(b)), b[2:], nil
+}
+
+func readInt32(b []byte) (int32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("message too short")
+	}
+	return int32(binary.BigEndian.Uint32(b)), b[4:], nil
+}
+
+// readCount reads an int16 element count
+func readCount(b []byte) (int16, []byte, error) {
+	count, b, err := readInt16(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if count < 0 {
+		return 0, nil, fmt.Errorf("negative count %d", count)
+	}
+	return count, b, nil
+}
+
+// readOIDs reads an int16 count followed by that many type OIDs
+func readOIDs(b []byte) ([]uint32, error) {
+	count, b, err := readCount(b)
+	if err != nil {
+		return nil, err
+	}
+	oids := make([]uint32, count)
+	for i := range oids {
+		var oid int32
+		if oid, b, err = readInt32(b); err != nil {
+			return nil, err
+		}
+		oids[i] = uint32(oid)
+	}
+	return oids, nil
+}
+
+// readInt16s reads an int16 count followed by that many int16 values
+func readInt16s(b []byte) ([]int16, []byte, error) {
+	count, b, err := readCount(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([]int16, count)
+	for i := range values {
+		if values[i], b, err = readInt16(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, b, nil
+}
@@ -0,0 +1,153 @@
+package pgwire
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Type OIDs of the parameter types that can be decoded from binary format
+const (
+	BoolOID        = 16
+	ByteaOID       = 17
+	NameOID        = 19
+	Int8OID        = 20
+	Int2OID        = 21
+	Int4OID        = 23
+	TextOID        = 25
+	OIDOID         = 26
+	Float4OID      = 700
+	Float8OID      = 701
+	BPCharOID      = 1042
+	VarcharOID     = 1043
+	DateOID        = 1082
+	TimestampOID   = 1114
+	TimestamptzOID = 1184
+	UUIDOID        = 2950
+	JSONBOID       = 3802
+)
+
+// Format codes for parameters and results
+const (
+	TextFormat   = 0
+	BinaryFormat = 1
+)
+
+// Microseconds between the Unix epoch and the Postgres epoch of 2000-01-01
+const postgresEpochOffset = 946684800000000
+
+// ParameterFormat returns the format code of the i-th parameter. No codes
+// means text for all, a single code applies to every parameter.
+func (b *Bind) ParameterFormat(i int) int16 {
+	switch len(b.ParameterFormats) {
+	case 0:
+		return TextFormat
+	case 1:
+		return b.ParameterFormats[0]
+	}
+	if i < len(b.ParameterFormats) {
+		return b.ParameterFormats[i]
+	}
+	return TextFormat
+}
+
+// DecodeParameter renders a non-NULL parameter value in Postgres text
+// format. Binary values of types it doesn't know are rendered as bytea hex.
+func DecodeParameter(value []byte, format int16, oid uint32) string {
+	if format == TextFormat {
+		return string(value)
+	}
+	if s, err := decodeBinary(value, oid); err == nil {
+		return s
+	}
+	return `\x` + hex.EncodeToString(value)
+}
+
+func decodeBinary(value []byte, oid uint32) (string, error) {
+	switch oid {
+	case BoolOID:
+		if len(value) != 1 {
+			break
+		}
+		if value[0] != 0 {
+			return "true", nil
+		}
+		return "false", nil
+	case Int2OID:
+		if len(value) != 2 {
+			break
+		}
+		return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10), nil
+	case Int4OID:
+		if len(value) != 4 {
+			break
+		}
+		return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10), nil
+	case OIDOID:
+		if len(value) != 4 {
+			break
+		}
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10), nil
+	case Int8OID:
+		if len(value) != 8 {
+			break
+		}
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10), nil
+	case Float4OID:
+		if len(value) != 4 {
+			break
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'g', -1, 32), nil
+	case Float8OID:
+		if len(value) != 8 {
+			break
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64), nil
+	case TextOID, VarcharOID, BPCharOID, NameOID:
+		return string(value), nil
+	case JSONBOID:
+		// Binary jsonb is a version byte followed by the JSON text
+		if len(value) < 1 || value[0] != 1 {
+			break
+		}
+		return string(value[1:]), nil
+	case ByteaOID:
+		return `\x` + hex.EncodeToString(value), nil
+	case UUIDOID:
+		if len(value) != 16 {
+			break
+		}
+		h := hex.EncodeToString(value)
+		return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], nil
+	case DateOID:
+		if len(value) != 4 {
+			break
+		}
+		days := int32(binary.BigEndian.Uint32(value))
+		return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(days)).Format("2006-01-02"), nil
+	case TimestampOID, TimestamptzOID:
+		if len(value) != 8 {
+			break
+		}
+		switch micros := int64(binary.BigEndian.Uint64(value)); micros {
+		case math.MaxInt64:
+			return "infinity", nil
+		case math.MinInt64:
+			return "-infinity", nil
+		}
+		if oid == TimestampOID {
+			return decodeTimestamp(value).Format("2006-01-02 15:04:05.999999"), nil
+		}
+		return decodeTimestamp(value).Format("2006-01-02 15:04:05.999999Z07:00"), nil
+	}
+	return "", fmt.Errorf("can't decode binary value of type %d", oid)
+}
+
+// decodeTimestamp converts microseconds since the Postgres epoch to UTC
+func decodeTimestamp(value []byte) time.Time {
+	micros := int64(binary.BigEndian.Uint64(value))
+	return time.UnixMicro(micros + postgresEpochOffset).UTC()
+}
@@ -0,0 +1,141 @@
+package pgwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func TestDecodeParameter(t *testing.T) {
+	minus := func(v int64) uint64 { return uint64(v) }
+	tests := []struct {
+		name   string
+		value  []byte
+		format int16
+		oid    uint32
+		want   string
+	}{
+		{"text format", []byte("42"), TextFormat, Int4OID, "42"},
+		{"bool true", []byte{1}, BinaryFormat, BoolOID, "true"},
+		{"bool false", []byte{0}, BinaryFormat, BoolOID, "false"},
+		{"int2", be16(0xfffe), BinaryFormat, Int2OID, "-2"},
+		{"int4", be32(123456), BinaryFormat, Int4OID, "123456"},
+		{"int4 negative", be32(0xffffffff), BinaryFormat, Int4OID, "-1"},
+		{"int8", be64(minus(-9000000000)), BinaryFormat, Int8OID, "-9000000000"},
+		{"oid", be32(0xffffffff), BinaryFormat, OIDOID, "4294967295"},
+		{"float4", be32(math.Float32bits(1.5)), BinaryFormat, Float4OID, "1.5"},
+		{"float4 shortest", be32(math.Float32bits(0.1)), BinaryFormat, Float4OID, "0.1"},
+		{"float8", be64(math.Float64bits(-0.25)), BinaryFormat, Float8OID, "-0.25"},
+		{"text", []byte("héllo"), BinaryFormat, TextOID, "héllo"},
+		{"jsonb", []byte("\x01{\"a\":1}"), BinaryFormat, JSONBOID, `{"a":1}`},
+		{"bytea", []byte{0xde, 0xad}, BinaryFormat, ByteaOID, `\xdead`},
+		{"uuid", []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+			BinaryFormat, UUIDOID, "12345678-9abc-def0-0123-456789abcdef"},
+		// Dates and timestamps count from 2000-01-01
+		{"date epoch", be32(0), BinaryFormat, DateOID, "2000-01-01"},
+		{"date before epoch", be32(0xffffffff), BinaryFormat, DateOID, "1999-12-31"},
+		{"timestamp epoch", be64(0), BinaryFormat, TimestampOID, "2000-01-01 00:00:00"},
+		{"timestamp fraction", be64(86401500000), BinaryFormat, TimestampOID, "2000-01-02 00:00:01.5"},
+		{"timestamp before epoch", be64(minus(-1)), BinaryFormat, TimestampOID, "1999-12-31 23:59:59.999999"},
+		{"timestamptz", be64(86400000000), BinaryFormat, TimestamptzOID, "2000-01-02 00:00:00Z"},
+		{"timestamp infinity", be64(math.MaxInt64), BinaryFormat, TimestampOID, "infinity"},
+		{"timestamptz -infinity", be64(minus(math.MinInt64)), BinaryFormat, TimestamptzOID, "-infinity"},
+		// Values of the wrong length, or of unknown types, are left as hex
+		{"int4 short", []byte{0, 1}, BinaryFormat, Int4OID, `\x0001`},
+		{"int8 long", make([]byte, 9), BinaryFormat, Int8OID, `\x000000000000000000`},
+		{"bool long", []byte{0, 1}, BinaryFormat, BoolOID, `\x0001`},
+		{"uuid short", []byte{1, 2, 3}, BinaryFormat, UUIDOID, `\x010203`},
+		{"timestamp short", []byte{0, 0, 0, 0}, BinaryFormat, TimestampOID, `\x00000000`},
+		{"jsonb version", []byte("\x02{}"), BinaryFormat, JSONBOID, `\x027b7d`},
+		{"unknown type", []byte{0xab}, BinaryFormat, 1700, `\xab`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DecodeParameter(tt.value, tt.format, tt.oid); got != tt.want {
+				t.Errorf("DecodeParameter(%v, %d, %d) = %q, want %q", tt.value, tt.format, tt.oid, got, tt.want)
+			}
+		})
+	}
+}
+
+// bindPayload encodes a Bind of the unnamed portal to statement s1, with
+// a nil value sent as NULL
+func bindPayload(formats []int16, values [][]byte) []byte {
+	b := []byte("\x00s1\x00")
+	b = append(b, be16(uint16(len(formats)))...)
+	for _, f := range formats {
+		b = append(b, be16(uint16(f))...)
+	}
+	b = append(b, be16(uint16(len(values)))...)
+	for _, v := range values {
+		if v == nil {
+			b = append(b, be32(0xffffffff)...)
+			continue
+		}
+		b = append(b, be32(uint32(len(v)))...)
+		b = append(b, v...)
+	}
+	// One result format, text
+	return append(b, 0, 1, 0, 0)
+}
+
+func TestParseBind(t *testing.T) {
+	payload := bindPayload([]int16{BinaryFormat, TextFormat, BinaryFormat}, [][]byte{be32(7), []byte("abc"), nil, {}})
+	bind, err := ParseBind(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bind.Portal != "" || bind.Statement != "s1" {
+		t.Errorf("got portal %q and statement %q", bind.Portal, bind.Statement)
+	}
+	if len(bind.Parameters) != 4 {
+		t.Fatalf("got %d parameters, want 4", len(bind.Parameters))
+	}
+	if !bytes.Equal(bind.Parameters[0], be32(7)) || string(bind.Parameters[1]) != "abc" {
+		t.Errorf("got parameters %q", bind.Parameters)
+	}
+	// A length of -1 is NULL, unlike an empty value
+	if bind.Parameters[2] != nil {
+		t.Errorf("NULL parameter is %q, want nil", bind.Parameters[2])
+	}
+	if bind.Parameters[3] == nil || len(bind.Parameters[3]) != 0 {
+		t.Errorf("empty parameter is %v, want empty and not nil", bind.Parameters[3])
+	}
+	if len(bind.ResultFormats) != 1 || bind.ResultFormats[0] != TextFormat {
+		t.Errorf("got result formats %v", bind.ResultFormats)
+	}
+
+	for i, want := range []int16{BinaryFormat, TextFormat, BinaryFormat, TextFormat} {
+		if got := bind.ParameterFormat(i); got != want {
+			t.Errorf("ParameterFormat(%d) = %d, want %d", i, got, want)
+		}
+	}
+	single := &Bind{ParameterFormats: []int16{BinaryFormat}}
+	none := &Bind{}
+	if single.ParameterFormat(5) != BinaryFormat || none.ParameterFormat(0) != TextFormat {
+		t.Error("a single format code must apply to every parameter, and none means text")
+	}
+}
+
+func TestParseBindInvalid(t *testing.T) {
+	valid := bindPayload(nil, [][]byte{be32(7)})
+	tests := map[string][]byte{
+		"unterminated portal": []byte("portal"),
+		"truncated":           valid[:len(valid)-6],
+		// A length longer than what is left of the message
+		"overrun":        append([]byte("\x00s1\x00\x00\x00\x00\x01"), be32(100)...),
+		"negative count": append([]byte("\x00s1\x00"), be16(0xffff)...),
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseBind(payload); err == nil {
+				t.Errorf("ParseBind(%v) succeeded", payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Protocol codes sent in place of a protocol version by special startup packets
+const (
+	CancelRequestCode   = 80877102
+	SSLRequestCode      = 80877103
+	GSSENCRequestCode   = 80877104
+	ProtocolVersion3    = 196608
+	maxStartupPacketLen = 10000
+)
+
+// MaxMessageLen bounds the size of a single message so a corrupt length
+// can't make the proxy allocate unbounded memory
+const MaxMessageLen = 1 << 30
+
+// Message is a single typed protocol message: a 1-byte type, a 4-byte
+// length that includes itself, and the payload
+type Message struct {
+	Type    byte
+	Payload []byte
+}
+
+// Bytes returns the message exactly as it appeared on the wire
+func (m Message) Bytes() []byte {
+	b := make([]byte, 5+len(m.Payload))
+	b[0] = m.Type
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(m.Payload)+4))
+	copy(b[5:], m.Payload)
+	return b
+}
+
+// StartupMessage is an untyped packet sent by the client before the
+// regular message flow: StartupMessage, SSLRequest, GSSENCRequest or
+// CancelRequest, told apart by Code
+type StartupMessage struct {
+	Code    uint32
+	Payload []byte
+}
+
+// Bytes returns the packet exactly as it appeared on the wire
+func (m StartupMessage) Bytes() []byte {
+	b := make([]byte, 8+len(m.Payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(m.Payload)+8))
+	binary.BigEndian.PutUint32(b[4:8], m.Code)
+	copy(b[8:], m.Payload)
+	return b
+}
+
+// Reader decodes framed protocol messages from a stream, reassembling
+// messages that span several reads and splitting reads that hold several
+// messages
+type Reader struct {
+	r *bufio.Reader
+}
+
+func MakeReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// ReadStartupMessage reads an untyped startup packet
+func (r *Reader) ReadStartupMessage() (*StartupMessage, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 8 || length > maxStartupPacketLen {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+	payload := make([]byte, length-8)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, err
+	}
+	return &StartupMessage{
+		Code:    binary.BigEndian.Uint32(header[4:8]),
+		Payload: payload,
+	}, nil
+}
+
+// ReadMessage reads the next typed message
+func (r *Reader) ReadMessage() (*Message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length < 4 || length > MaxMessageLen {
+		return nil, fmt.Errorf("invalid length %d for message type %q", length, header[0])
+	}
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Type:    header[0],
+		Payload: payload,
+	}, nil
+}
+
+// ReadByte reads a single unframed byte, such as the server's answer to
+// an SSLRequest
+func (r *Reader) ReadByte() (byte, error) {
+	return r.r.ReadByte()
+}
+
+// Buffered returns the number of bytes already read from the stream but
+// not yet consumed
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// Underlying returns the buffered stream so a raw copy can pick up where
+// message decoding stopped
+func (r *Reader) Underlying() io.Reader {
+	return r.r
+}
@@ -0,0 +1,142 @@
+package pgwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns the data of r at most n bytes per Read, as a TCP
+// stream may split it anywhere
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func header(length uint32, rest ...uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, length)
+	for _, v := range rest {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func TestReadMessageFraming(t *testing.T) {
+	messages := []Message{
+		{Type: QueryMessage, Payload: []byte("SELECT 1\x00")},
+		{Type: SyncMessage, Payload: []byte{}},
+		{Type: ParseMessage, Payload: append([]byte("s1\x00"), bytes.Repeat([]byte("x"), 10000)...)},
+		{Type: ReadyForQueryMessage, Payload: []byte{TxIdle}},
+	}
+	var stream []byte
+	for _, m := range messages {
+		stream = append(stream, m.Bytes()...)
+	}
+
+	readers := map[string]func() io.Reader{
+		// Several messages coalesced into one read
+		"one read": func() io.Reader { return bytes.NewReader(stream) },
+		// Every message split across reads, headers included
+		"one byte reads":  func() io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) },
+		"3 byte reads":    func() io.Reader { return chunkReader{bytes.NewReader(stream), 3} },
+		"4096 byte reads": func() io.Reader { return chunkReader{bytes.NewReader(stream), 4096} },
+	}
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			r := MakeReader(reader())
+			for i, want := range messages {
+				got, err := r.ReadMessage()
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+					t.Fatalf("message %d is %q with %d bytes, want %q with %d bytes", i, got.Type, len(got.Payload), want.Type, len(want.Payload))
+				}
+			}
+			if _, err := r.ReadMessage(); err != io.EOF {
+				t.Fatalf("got %v after the last message, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	full := Message{Type: QueryMessage, Payload: []byte("SELECT 1\x00")}.Bytes()
+	r := MakeReader(bytes.NewReader(full[:len(full)-2]))
+	if _, err := r.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v for a truncated message, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReadMessageInvalidLength(t *testing.T) {
+	tests := map[string]uint32{
+		// The length includes its own 4 bytes
+		"short":    3,
+		"zero":     0,
+		"oversize": MaxMessageLen + 1,
+	}
+	for name, length := range tests {
+		t.Run(name, func(t *testing.T) {
+			stream := append([]byte{QueryMessage}, header(length)...)
+			if _, err := MakeReader(bytes.NewReader(stream)).ReadMessage(); err == nil {
+				t.Fatalf("length %d was accepted", length)
+			}
+		})
+	}
+}
+
+func TestReadStartupMessage(t *testing.T) {
+	options := []byte("user\x00alice\x00database\x00shop\x00\x00")
+	tests := []struct {
+		name    string
+		packet  []byte
+		code    uint32
+		payload []byte
+	}{
+		{"SSLRequest", header(8, SSLRequestCode), SSLRequestCode, []byte{}},
+		{"GSSENCRequest", header(8, GSSENCRequestCode), GSSENCRequestCode, []byte{}},
+		// Process ID and secret key
+		{"CancelRequest", header(16, CancelRequestCode, 1234, 5678), CancelRequestCode, header(1234, 5678)},
+		{"StartupMessage", append(header(uint32(8+len(options)), ProtocolVersion3), options...), ProtocolVersion3, options},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Followed by a typed message, which must be left unread
+			next := Message{Type: QueryMessage, Payload: []byte("SELECT 1\x00")}
+			stream := append(append([]byte{}, tt.packet...), next.Bytes()...)
+			r := MakeReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+			got, err := r.ReadStartupMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Code != tt.code || !bytes.Equal(got.Payload, tt.payload) {
+				t.Fatalf("got code %d with payload %v, want %d with %v", got.Code, got.Payload, tt.code, tt.payload)
+			}
+			if !bytes.Equal(got.Bytes(), tt.packet) {
+				t.Errorf("Bytes() = %v, want %v", got.Bytes(), tt.packet)
+			}
+			if m, err := r.ReadMessage(); err != nil || m.Type != QueryMessage {
+				t.Fatalf("got %v, %v after the startup packet, want the Query", m, err)
+			}
+		})
+	}
+}
+
+func TestReadStartupMessageInvalidLength(t *testing.T) {
+	for _, length := range []uint32{0, 7, maxStartupPacketLen + 1} {
+		stream := header(length, ProtocolVersion3)
+		if _, err := MakeReader(bytes.NewReader(stream)).ReadStartupMessage(); err == nil {
+			t.Errorf("startup packet length %d was accepted", length)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+// Package sqlnorm normalizes SQL text so that queries differing only in
+// their constants, spacing or comments can be told to be the same, much
+// like pg_stat_statements does with its queryid
+package sqlnorm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	// Unquoted keyword or identifier
+	wordToken tokenKind = iota
+	// "Quoted" identifier
+	quotedToken
+	// Number, string or bind parameter, replaced by a placeholder
+	constToken
+	// A collapsed list of constants
+	listToken
+	// Operator or punctuation
+	opToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// Whether whitespace or a comment came before the token
+	space bool
+}
+
+// Normalize replaces constants with $1, $2, ... in order of appearance,
+// IN-lists of constants with "(...)" and VALUES lists with their first
+// row, and collapses whitespace and comments to a single space.
+// Parameters the query already had are renumbered along with the rest.
+func Normalize(query string) string {
+	var b strings.Builder
+	placeholders := 0
+	for i, t := range normalize(query) {
+		if i > 0 && t.space {
+			b.WriteByte(' ')
+		}
+		switch t.kind {
+		case constToken:
+			placeholders++
+			b.WriteString("$" + strconv.Itoa(placeholders))
+		case listToken:
+			b.WriteString("...")
+		default:
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+// Fingerprint returns a hash of the normalized query as 16 hex digits. It
+// ignores spacing entirely and the case of unquoted words, so queries
+// Postgres would parse the same way share a fingerprint.
+func Fingerprint(query string) string {
+	h := fnv.New64a()
+	for _, t := range normalize(query) {
+		switch t.kind {
+		case constToken:
+			h.Write([]byte{'$'})
+		case listToken:
+			h.Write([]byte("..."))
+		case wordToken:
+			h.Write([]byte(strings.ToLower(t.text)))
+		default:
+			h.Write([]byte(t.text))
+		}
+		// Keep adjacent tokens such as "a" "b" and "ab" apart
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// normalize tokenizes query and collapses its lists of constants
+func normalize(query string) []token {
+	tokens := tokenize(query)
+	// A trailing semicolon doesn't change the statement
+	for len(tokens) > 0 && tokens[len(tokens)-1].text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	normalized := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		normalized = append(normalized, t)
+		if t.kind != wordToken {
+			continue
+		}
+		switch strings.ToLower(t.text) {
+		case "in":
+			// IN (1, 2, 3) becomes IN (...) whatever the number of values
+			end, ok := constList(tokens, i+1)
+			if !ok {
+				continue
+			}
+			normalized = append(normalized, tokens[i+1], token{kind: listToken}, token{kind: opToken, text: ")"})
+			i = end
+		case "values":
+			// VALUES (1, 2), (3, 4) keeps only its first row
+			end := closingParen(tokens, i+1)
+			if end < 0 {
+				continue
+			}
+			normalized = append(normalized, tokens[i+1:end+1]...)
+			i = end
+			for i+2 < len(tokens) && tokens[i+1].text == "," && tokens[i+2].text == "(" {
+				next := closingParen(tokens, i+2)
+				if next < 0 {
+					break
+				}
+				i = next
+			}
+		}
+	}
+	return normalized
+}
+
+// constList returns the index of the ")" closing a parenthesized list of
+// constants starting at i
+func constList(tokens []token, i int) (int, bool) {
+	if i >= len(tokens) || tokens[i].text != "(" {
+		return 0, false
+	}
+	for i++; i < len(tokens); i += 2 {
+		if tokens[i].kind != constToken || i+1 >= len(tokens) {
+			return 0, false
+		}
+		switch tokens[i+1].text {
+		case ")":
+			return i + 1, true
+		case ",":
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// closingParen returns the index of the ")" matching the "(" at i, or -1
+func closingParen(tokens []token, i int) int {
+	if i >= len(tokens) || tokens[i].text != "(" {
+		return -1
+	}
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// tokenize splits query into tokens following the lexical rules of
+// Postgres, dropping whitespace and comments
+func tokenize(query string) []token {
+	var tokens []token
+	space := false
+	emit := func(kind tokenKind, text string) {
+		tokens = append(tokens, token{kind: kind, text: text, space: space})
+		space = false
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case isSpace(c):
+			space = true
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			space = true
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			space = true
+			i = skipBlockComment(query, i)
+		case c == '\'':
+			// A prefix such as E'...' or X'...' lexes as a word first
+			escapes := false
+			if n := len(tokens); n > 0 && !space && tokens[n-1].kind == wordToken {
+				switch strings.ToLower(tokens[n-1].text) {
+				case "e":
+					escapes = true
+					fallthrough
+				case "b", "x", "n":
+					space = tokens[n-1].space
+					tokens = tokens[:n-1]
+				}
+			}
+			i = skipString(query, i, escapes)
+			emit(constToken, "")
+		case c == '"':
+			end := skipQuoted(query, i, '"')
+			emit(quotedToken, query[i:end])
+			i = end
+		case c == '$':
+			if end := skipDigits(query, i+1); end > i+1 {
+				// Bind parameter
+				i = end
+				emit(constToken, "")
+			} else if end, ok := skipDollarQuoted(query, i); ok {
+				i = end
+				emit(constToken, "")
+			} else {
+				emit(opToken, "$")
+				i++
+			}
+		case isDigit(c) || c == '.' && i+1 < len(query) && isDigit(query[i+1]):
+			i = skipNumber(query, i)
+			emit(constToken, "")
+		case isWordStart(c):
+			end := i + 1
+			for end < len(query) && isWordPart(query[end]) {
+				end++
+			}
+			emit(wordToken, query[i:end])
+			i = end
+		case strings.IndexByte("(),;[]", c) >= 0:
+			emit(opToken, string(c))
+			i++
+		default:
+			end := i + 1
+			if c == ':' || c == '.' {
+				if c == ':' && end < len(query) && query[end] == ':' {
+					end++
+				}
+			} else {
+				for end < len(query) && isOperator(query[end]) &&
+					!strings.HasPrefix(query[end:], "--") && !strings.HasPrefix(query[end:], "/*") {
+					end++
+				}
+			}
+			op := query[i:end]
+			i = end
+			// Fold the sign of a negative number into the constant, as in
+			// a = -1, but not a subtraction as in a - 1
+			if op == "-" && i < len(query) && (isDigit(query[i]) || query[i] == '.') && !followsOperand(tokens) {
+				i = skipNumber(query, i)
+				emit(constToken, "")
+				continue
+			}
+			emit(opToken, op)
+		}
+	}
+	return tokens
+}
+
+// followsOperand reports whether the last token ends an operand, so that
+// a following "-" is a subtraction
+func followsOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	switch t := tokens[len(tokens)-1]; t.kind {
+	case wordToken:
+		return !expressionKeywords[strings.ToLower(t.text)]
+	case quotedToken, constToken:
+		return true
+	default:
+		return t.text == ")" || t.text == "]"
+	}
+}
+
+// expressionKeywords are the keywords an expression follows, as in
+// SELECT -1 or LIMIT -1. Other words are identifiers or keywords such as
+// END and NULL that end an operand themselves.
+var expressionKeywords = map[string]bool{
+	"all": true, "and": true, "any": true, "between": true, "by": true,
+	"case": true, "distinct": true, "else": true, "for": true, "from": true,
+	"having": true, "ilike": true, "in": true, "is": true, "like": true,
+	"limit": true, "not": true, "offset": true, "on": true, "or": true,
+	"return": true, "returning": true, "select": true, "similar": true,
+	"some": true, "then": true, "using": true, "when": true, "where": true,
+}
+
+func skipBlockComment(query string, i int) int {
+	// Block comments nest in Postgres
+	depth := 0
+	for i < len(query) {
+		switch {
+		case strings.HasPrefix(query[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(query[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// skipString returns the index after the string literal starting at i,
+// where quotes are escaped by doubling them and, with escapes, by a
+// backslash
+func skipString(query string, i int, escapes bool) int {
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case '\'':
+			if i+1 < len(query) && query[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+func skipQuoted(query string, i int, quote byte) int {
+	for i++; i < len(query); i++ {
+		if query[i] == quote {
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+// skipDollarQuoted returns the index after the $tag$...$tag$ string
+// starting at i
+func skipDollarQuoted(query string, i int) (int, bool) {
+	end := i + 1
+	for end < len(query) && query[end] != '$' {
+		if !isWordPart(query[end]) {
+			return 0, false
+		}
+		end++
+	}
+	if end >= len(query) || end > i+1 && isDigit(query[i+1]) {
+		return 0, false
+	}
+	tag := query[i : end+1]
+	closing := strings.Index(query[end+1:], tag)
+	if closing < 0 {
+		return len(query), true
+	}
+	return end + 1 + closing + len(tag), true
+}
+
+// skipNumber returns the index after the numeric constant starting at i:
+// decimal with an optional fraction and exponent, or 0x, 0o and 0b
+// integers, any of them with _ separators
+func skipNumber(query string, i int) int {
+	if strings.HasPrefix(query[i:], "0") && i+1 < len(query) && strings.IndexByte("xXoObB", query[i+1]) >= 0 {
+		end := i + 2
+		for end < len(query) && (isHexDigit(query[end]) || query[end] == '_') {
+			end++
+		}
+		return end
+	}
+	i = skipDigits(query, i)
+	if i < len(query) && query[i] == '.' && !strings.HasPrefix(query[i:], "..") {
+		i = skipDigits(query, i+1)
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		end := i + 1
+		if end < len(query) && (query[end] == '+' || query[end] == '-') {
+			end++
+		}
+		if digits := skipDigits(query, end); digits > end {
+			i = digits
+		}
+	}
+	return i
+}
+
+func skipDigits(query string, i int) int {
+	for i < len(query) && (isDigit(query[i]) || query[i] == '_') {
+		i++
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isWordStart reports whether c starts a keyword or identifier. Bytes of
+// multi-byte UTF-8 characters count as letters.
+func isWordStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+func isWordPart(c byte) bool {
+	return isWordStart(c) || isDigit(c) || c == '$'
+}
+
+func isOperator(c byte) bool {
+	return strings.IndexByte("+-*/<>=~!@#%^&|`?", c) >= 0
+}
@@ -0,0 +1,90 @@
+package sqlnorm
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"integer", "SELECT * FROM users WHERE id = 42", "SELECT * FROM users WHERE id = $1"},
+		{"string and float", "SELECT * FROM users WHERE name = 'bob' AND score > 3.5e-2", "SELECT * FROM users WHERE name = $1 AND score > $2"},
+		{"bind parameters renumbered", "SELECT * FROM t WHERE a = $2 AND b = 7", "SELECT * FROM t WHERE a = $1 AND b = $2"},
+		{"IN list", "SELECT * FROM t WHERE id IN (1, 2, 3)", "SELECT * FROM t WHERE id IN (...)"},
+		{"IN list of parameters", "SELECT * FROM t WHERE id IN ($1, $2)", "SELECT * FROM t WHERE id IN (...)"},
+		{"IN subquery", "SELECT * FROM t WHERE id IN (SELECT id FROM u)", "SELECT * FROM t WHERE id IN (SELECT id FROM u)"},
+		{"VALUES rows", "INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y'), (3, 'z')", "INSERT INTO t (a, b) VALUES ($1, $2)"},
+		{"escape string", `SELECT E'it\'s', 'it''s'`, "SELECT $1, $2"},
+		{"prefixed strings", "SELECT X'ff', B'01', N'n', 0x1F, 1_000", "SELECT $1, $2, $3, $4, $5"},
+		{"dollar quoted", "SELECT $$a 'b' c$$, $tag$x$tag$", "SELECT $1, $2"},
+		{"comments", "SELECT 1 -- trailing\n/* block /* nested */ */ ;", "SELECT $1"},
+		{"whitespace", "SELECT\n\t a ,  b\r\nFROM t", "SELECT a , b FROM t"},
+		{"casts", "SELECT '42'::int, x::text", "SELECT $1::int, x::text"},
+		{"quoted identifiers", `SELECT "Id" FROM "Users"`, `SELECT "Id" FROM "Users"`},
+		{"negative after keyword", "SELECT -1", "SELECT $1"},
+		{"negative LIMIT", "SELECT * FROM t LIMIT -1", "SELECT * FROM t LIMIT $1"},
+		{"negative in CASE", "SELECT CASE WHEN a THEN -1 ELSE -2 END - 1", "SELECT CASE WHEN a THEN $1 ELSE $2 END - $3"},
+		{"subtraction", "SELECT a - 1, a -1, (a)-1", "SELECT a - $1, a -$2, (a)-$3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Normalize(tt.query); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"constants", "SELECT * FROM t WHERE id = 1", "SELECT * FROM t WHERE id = 2", true},
+		{"negative constant", "SELECT 1", "SELECT -1", true},
+		{"negative LIMIT", "SELECT * FROM t LIMIT 1", "SELECT * FROM t LIMIT -1", true},
+		{"negative THEN", "SELECT CASE WHEN a THEN 1 END", "SELECT CASE WHEN a THEN -1 END", true},
+		{"IN list length", "SELECT * FROM t WHERE id IN (1)", "SELECT * FROM t WHERE id IN (1, 2, 3)", true},
+		{"VALUES rows", "INSERT INTO t VALUES (1, 'a')", "INSERT INTO t VALUES (1, 'a'), (2, 'b')", true},
+		{"string kinds", "SELECT 'a'", "SELECT $$a$$", true},
+		{"escape string", "SELECT 'a'", `SELECT E'\'a'`, true},
+		{"parameter or literal", "SELECT * FROM t WHERE id = $1", "SELECT * FROM t WHERE id = 7", true},
+		{"keyword case", "select * from t", "SELECT * FROM t", true},
+		{"spacing and comments", "SELECT a,b FROM t", "SELECT a , b /* note */ FROM t -- end", true},
+		{"trailing semicolon", "SELECT 1;", "SELECT 1", true},
+		{"casts", "SELECT 1::int", "SELECT 1::bigint", false},
+		{"quoted identifier case", `SELECT "Id" FROM t`, `SELECT "id" FROM t`, false},
+		{"columns", "SELECT a FROM t", "SELECT b FROM t", false},
+		{"adjacent tokens", `SELECT "a" "b"`, `SELECT "ab"`, false},
+		{"subtraction", "SELECT a - 1", "SELECT a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := Fingerprint(tt.a), Fingerprint(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("Fingerprint(%q) = %s, Fingerprint(%q) = %s, want same = %v", tt.a, a, tt.b, b, tt.same)
+			}
+		})
+	}
+}
+
+// Fingerprints are persisted with captured queries, so they must not
+// change between versions
+func TestFingerprintStable(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM users WHERE id = 42", "34f8f43d1d21251c"},
+		{"SELECT * FROM t WHERE id IN (1, 2, 3)", "ba22ddfade71738d"},
+		{"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')", "b33906d0d63d3dbb"},
+		{"SELECT '42'::int, x::text", "0947499f72d24f5b"},
+	}
+	for _, tt := range tests {
+		if got := Fingerprint(tt.query); got != tt.want {
+			t.Errorf("Fingerprint(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"log"
+)
+
+// Backend persists captured queries so a capture survives proxy restarts
+// and can be read from disk without the API
+type Backend interface {
+	// Append persists queries, in order, after every query appended before
+	// them
+	Append(queries []QueryExecuted) error
+	// Load calls fn with every persisted query, oldest first, without
+	// holding them all in memory. It stops at the first error fn returns.
+	Load(fn func(QueryExecuted) error) error
+	// Reset removes every persisted query
+	Reset() error
+	Close() error
+}
+
+// Kinds of backend accepted by OpenBackend
+const (
+	BackendMemory = "memory"
+	BackendNDJSON = "ndjson"
+	BackendBolt   = "bolt"
+)
+
+// OpenBackend opens the backend of the given kind at path. The memory
+// kind persists nothing and returns a nil Backend.
+func OpenBackend(kind, path string) (Backend, error) {
+	switch kind {
+	case BackendMemory:
+		return nil, nil
+	case BackendNDJSON:
+		b, err := OpenNDJSONBackend(path)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case BackendBolt:
+		b, err := OpenBoltBackend(path)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, expected %s, %s or %s", kind, BackendMemory, BackendNDJSON, BackendBolt)
+	}
+}
+
+const (
+	// Queries queued for the backend, past which new ones are kept in
+	// memory only until it catches up
+	writeBuffer = 4096
+	// Most queries persisted in one Append
+	maxWriteBatch = 256
+)
+
+// backendWrite is a query for the persisting goroutine to append or, with
+// reset set, a request to remove every persisted query
+type backendWrite struct {
+	query QueryExecuted
+	reset chan error
+}
+
+// wakePersist signals the persisting goroutine that there are writes,
+// without waiting for it. Called with mu held.
+func (qs *QueryStore) wakePersist() {
+	select {
+	case qs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// persist appends the queued queries to the backend until Close. Queries
+// queued meanwhile are appended together, so a burst costs one write, and
+// with bolt one sync, rather than one per query.
+func (qs *QueryStore) persist() {
+	defer close(qs.persisted)
+	var batch []QueryExecuted
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := qs.backend.Append(batch); err != nil {
+			log.Printf("Failed to persist %d queries: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for range qs.wake {
+		qs.mu.Lock()
+		writes, unpersisted, closing := qs.writes, qs.unpersisted, qs.closing
+		qs.writes, qs.unpersisted = nil, 0
+		qs.mu.Unlock()
+
+		if unpersisted > 0 {
+			log.Printf("Persisting fell behind, %d queries are kept in memory only", unpersisted)
+		}
+		for _, w := range writes {
+			if w.reset != nil {
+				flush()
+				w.reset <- qs.backend.Reset()
+				continue
+			}
+			batch = append(batch, w.query)
+			if len(batch) >= maxWriteBatch {
+				flush()
+			}
+		}
+		flush()
+		if closing {
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var queriesBucket = []byte("queries")
+
+// BoltBackend keeps queries in an embedded bbolt key-value file, keyed by
+// a big-endian sequence number so iteration follows capture order
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func OpenBoltBackend(path string) (*BoltBackend, error) {
+	db, err := openBolt(path, false)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(queriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{
+		db: db,
+	}, nil
+}
+
+// Append stores queries in one transaction, so they cost one sync
+func (b *BoltBackend) Append(queries []QueryExecuted) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queriesBucket)
+		for _, q := range queries {
+			value, err := json.Marshal(q)
+			if err != nil {
+				return err
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+			if err := bucket.Put(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) Load(fn func(QueryExecuted) error) error {
+	return loadBolt(b.db, fn)
+}
+
+func (b *BoltBackend) Reset() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(queriesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(queriesBucket)
+		return err
+	})
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+// ReadBoltFile reads the queries of a bolt capture file. It fails while
+// a running proxy holds the file open, which bolt locks exclusively.
+func ReadBoltFile(path string) ([]QueryExecuted, error) {
+	db, err := openBolt(path, true)
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is locked by a running proxy, stop it first or use the %s backend", path, BackendNDJSON)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	queries := []QueryExecuted{}
+	err = loadBolt(db, func(q QueryExecuted) error {
+		queries = append(queries, q)
+		return nil
+	})
+	return queries, err
+}
+
+func openBolt(path string, readOnly bool) (*bolt.DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt backend needs a file path")
+	}
+	return bolt.Open(path, 0644, &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: readOnly,
+	})
+}
+
+func loadBolt(db *bolt.DB, fn func(QueryExecuted) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queriesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			var q QueryExecuted
+			if err := json.Unmarshal(value, &q); err != nil {
+				return err
+			}
+			return fn(q)
+		})
+	})
+}
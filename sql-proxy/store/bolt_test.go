@@ -0,0 +1,32 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadBoltFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.bolt")
+	b, err := OpenBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append([]QueryExecuted{{ID: 1, Query: "SELECT 1"}, {ID: 2, Query: "SELECT 2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The running proxy's lock keeps readers out
+	if _, err := ReadBoltFile(path); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("ReadBoltFile of an open file returned %v, want it locked", err)
+	}
+
+	b.Close()
+	got, err := ReadBoltFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+		t.Errorf("got %+v, want queries 1 and 2", got)
+	}
+}
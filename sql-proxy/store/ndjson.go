@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// NDJSONBackend appends each query as one JSON line to a file. A crash can
+// leave a partial last line, which is cut off when the file is opened
+// again so the next query starts on a line of its own.
+type NDJSONBackend struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenNDJSONBackend(path string) (*NDJSONBackend, error) {
+	if path == "" {
+		return nil, fmt.Errorf("ndjson backend needs a file path")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := trimPartialLine(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to repair %s: %v", path, err)
+	}
+	return &NDJSONBackend{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (b *NDJSONBackend) Append(queries []QueryExecuted) error {
+	var lines []byte
+	for _, q := range queries {
+		line, err := json.Marshal(q)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.file.Write(lines)
+	return err
+}
+
+func (b *NDJSONBackend) Load(fn func(QueryExecuted) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return readNDJSON(b.path, fn)
+}
+
+func (b *NDJSONBackend) Reset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Writes append, so truncating is enough to start over
+	return b.file.Truncate(0)
+}
+
+func (b *NDJSONBackend) Close() error {
+	return b.file.Close()
+}
+
+// trimPartialLine truncates file after its last newline, dropping a line
+// left unfinished by a crash mid-write
+func trimPartialLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	// Search backwards a chunk at a time, as the file may be large
+	buf := make([]byte, 4096)
+	for offset := size; offset > 0; {
+		n := int64(len(buf))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(buf[:n], offset); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			if end := offset + int64(i) + 1; end < size {
+				return file.Truncate(end)
+			}
+			return nil
+		}
+	}
+	// Without any newline the only line is partial
+	if size > 0 {
+		return file.Truncate(0)
+	}
+	return nil
+}
+
+// ReadNDJSONFile reads the queries of an NDJSON capture file. Lines that
+// aren't valid JSON, such as a partial line left by a crash mid-write, are
+// logged and skipped.
+func ReadNDJSONFile(path string) ([]QueryExecuted, error) {
+	queries := []QueryExecuted{}
+	err := readNDJSON(path, func(q QueryExecuted) error {
+		queries = append(queries, q)
+		return nil
+	})
+	return queries, err
+}
+
+// readNDJSON calls fn with each query of an NDJSON capture file, reading
+// it a line at a time
+func readNDJSON(path string, fn func(QueryExecuted) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		if len(bytes.TrimSpace(line)) > 0 {
+			var q QueryExecuted
+			if err := json.Unmarshal(line, &q); err != nil {
+				log.Printf("Skipping invalid line %d in %s: %v", n, path, err)
+			} else if err := fn(q); err != nil {
+				return err
+			}
+		}
+		if eof {
+			return nil
+		}
+	}
+}
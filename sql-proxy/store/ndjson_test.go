@@ -0,0 +1,114 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendRaw writes data to the end of the file at path, bypassing the
+// backend, to simulate what a crash leaves behind
+func appendRaw(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadAll(t *testing.T, b Backend) []QueryExecuted {
+	t.Helper()
+	var queries []QueryExecuted
+	err := b.Load(func(q QueryExecuted) error {
+		queries = append(queries, q)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queries
+}
+
+func TestNDJSONBackendRecoversFromPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+
+	b, err := OpenNDJSONBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append([]QueryExecuted{{ID: 1, Query: "SELECT 1"}}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	// A crash mid-write leaves the last line without its newline
+	appendRaw(t, path, `{"ID":2,"Query":"INSE`)
+
+	// The first restart drops the partial line, so the next query is
+	// appended on a line of its own
+	b, err = OpenNDJSONBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loadAll(t, b); len(got) != 1 {
+		t.Fatalf("got %d queries after the first restart, want 1", len(got))
+	}
+	if err := b.Append([]QueryExecuted{{ID: 3, Query: "SELECT 3"}}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	b, err = OpenNDJSONBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	got := loadAll(t, b)
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 3 {
+		t.Fatalf("got %+v after the second restart, want queries 1 and 3", got)
+	}
+}
+
+func TestNDJSONBackendWithoutNewline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+	if err := os.WriteFile(path, []byte(`{"ID":1,"Que`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenNDJSONBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if got := loadAll(t, b); len(got) != 0 {
+		t.Fatalf("got %d queries, want 0", len(got))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("file is %d bytes, want the partial line truncated", info.Size())
+	}
+}
+
+func TestReadNDJSONFileSkipsInvalidLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+	data := `{"ID":1,"Query":"SELECT 1"}
+{"ID":2,"Query":"INSE{"ID":3,"Query":"SELECT 3"}
+
+{"ID":4,"Query":"SELECT 4"}
+{"ID":5,"Qu`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadNDJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 4 {
+		t.Fatalf("got %+v, want queries 1 and 4", got)
+	}
+}
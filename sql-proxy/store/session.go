@@ -0,0 +1,125 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Session is a named capture window. A query belongs to a session when it
+// starts while the session runs and, if the session has an
+// ApplicationName, comes from a connection with that application_name. A
+// query tagged with a /* recon:session=<id> */ comment belongs to that
+// session whenever it runs.
+type Session struct {
+	ID              string
+	Name            string
+	ApplicationName string `json:",omitempty"`
+	StartTime       time.Time
+	// Nil while the session is running
+	StopTime *time.Time `json:",omitempty"`
+}
+
+// ErrSessionNotFound is returned for an unknown session ID
+var ErrSessionNotFound = fmt.Errorf("session not found")
+
+var sessionComment = regexp.MustCompile(`recon:session=([A-Za-z0-9_-]+)`)
+
+// Running reports whether the session hasn't been stopped
+func (s Session) Running() bool {
+	return s.StopTime == nil
+}
+
+// Contains reports whether q belongs to the session
+func (s Session) Contains(q QueryExecuted) bool {
+	for _, m := range sessionComment.FindAllStringSubmatch(q.Query, -1) {
+		if m[1] == s.ID {
+			return true
+		}
+	}
+	if q.StartTime.Before(s.StartTime) {
+		return false
+	}
+	if !s.Running() && !q.StartTime.Before(*s.StopTime) {
+		return false
+	}
+	return s.ApplicationName == "" || s.ApplicationName == q.ApplicationName
+}
+
+// StartSession starts a capture window, optionally limited to connections
+// with the given application_name
+func (qs *QueryStore) StartSession(name, applicationName string) (Session, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Session{}, err
+	}
+	s := &Session{
+		ID:              hex.EncodeToString(id),
+		Name:            name,
+		ApplicationName: applicationName,
+		StartTime:       time.Now(),
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.sessions[s.ID] = s
+	qs.sessionOrder = append(qs.sessionOrder, s.ID)
+	return *s, nil
+}
+
+// StopSession ends a capture window. Stopping a stopped session keeps its
+// original stop time.
+func (qs *QueryStore) StopSession(id string) (Session, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	s, ok := qs.sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	if s.Running() {
+		now := time.Now()
+		s.StopTime = &now
+	}
+	return *s, nil
+}
+
+func (qs *QueryStore) GetSession(id string) (Session, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	s, ok := qs.sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return *s, nil
+}
+
+// ListSessions returns every session in the order they started
+func (qs *QueryStore) ListSessions() []Session {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	sessions := make([]Session, 0, len(qs.sessionOrder))
+	for _, id := range qs.sessionOrder {
+		sessions = append(sessions, *qs.sessions[id])
+	}
+	return sessions
+}
+
+// ListSessionQueries returns the stored queries that belong to a session
+func (qs *QueryStore) ListSessionQueries(id string) ([]QueryExecuted, error) {
+	s, err := qs.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	queries := []QueryExecuted{}
+	for _, q := range qs.ListQueries() {
+		if s.Contains(q) {
+			queries = append(queries, q)
+		}
+	}
+	return queries, nil
+}
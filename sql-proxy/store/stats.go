@@ -0,0 +1,96 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/droptableifexists/recon/sql-proxy/sqlnorm"
+)
+
+// QueryStats aggregates the runs of one normalized query, much like a row
+// of pg_stat_statements
+type QueryStats struct {
+	Fingerprint string
+	// The normalized query, and the first run of it as it was sent
+	Query   string
+	Example string
+	Calls   int
+	// Time spent in the query across all calls, and per call
+	TotalDuration time.Duration
+	MeanDuration  time.Duration
+	P95Duration   time.Duration
+	Rows          int64
+	Errors        int
+	// Start times of the first and last call
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// ListStats aggregates the captured queries by fingerprint
+func (qs *QueryStore) ListStats() []QueryStats {
+	return AggregateStats(qs.ListQueries())
+}
+
+// AggregateStats groups queries by fingerprint, most total time first
+func AggregateStats(queries []QueryExecuted) []QueryStats {
+	stats := []QueryStats{}
+	durations := [][]time.Duration{}
+	index := map[string]int{}
+	for _, q := range queries {
+		fingerprint := q.Fingerprint
+		if fingerprint == "" {
+			fingerprint = sqlnorm.Fingerprint(q.Query)
+		}
+		i, ok := index[fingerprint]
+		if !ok {
+			i = len(stats)
+			index[fingerprint] = i
+			stats = append(stats, QueryStats{
+				Fingerprint: fingerprint,
+				Query:       sqlnorm.Normalize(q.Query),
+				Example:     q.Query,
+				FirstSeen:   q.StartTime,
+				LastSeen:    q.StartTime,
+			})
+			durations = append(durations, nil)
+		}
+		s := &stats[i]
+		s.Calls++
+		s.TotalDuration += q.Duration
+		s.Rows += q.Rows
+		if q.Error != nil {
+			s.Errors++
+		}
+		if q.StartTime.Before(s.FirstSeen) {
+			s.FirstSeen = q.StartTime
+		}
+		if q.StartTime.After(s.LastSeen) {
+			s.LastSeen = q.StartTime
+		}
+		durations[i] = append(durations[i], q.Duration)
+	}
+
+	for i := range stats {
+		s := &stats[i]
+		s.MeanDuration = s.TotalDuration / time.Duration(s.Calls)
+		s.P95Duration = percentile(durations[i], 0.95)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].TotalDuration > stats[j].TotalDuration
+	})
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of durations, which it
+// sorts
+func percentile(durations []time.Duration, p float64) time.Duration {
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	rank := int(math.Ceil(p * float64(len(durations))))
+	if rank < 1 {
+		rank = 1
+	}
+	return durations[rank-1]
+}
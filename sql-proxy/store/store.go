@@ -1,21 +1,408 @@
 package store
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/droptableifexists/recon/sql-proxy/metrics"
+	"github.com/droptableifexists/recon/sql-proxy/sqlnorm"
+)
+
 type QueryExecuted struct {
+	// Assigned by the store in the order queries are added, used as the
+	// pagination cursor
+	ID    uint64
 	Query string
+	// Hash of the query with its constants, spacing and comments
+	// normalized, shared by queries that differ only in those
+	Fingerprint string
+	// Connection the query ran on, with the database and application_name
+	// from its startup packet
+	ConnectionID    uint64
+	Database        string
+	ApplicationName string
+	// Transaction block the query ran in, 0 outside of one
+	TransactionID uint64
+	// Transaction status of the ReadyForQuery ending the query's batch: I
+	// idle, T in a transaction block, E in a failed one. Empty in captures
+	// from before it was recorded.
+	TransactionStatus string `json:",omitempty"`
+	// Name of the prepared statement for extended-protocol queries, empty
+	// for the unnamed statement and for simple queries
+	StatementName string
+	// Bind parameter values in Postgres text format, nil for NULL
+	Parameters []*string
+	// Command tag of the backend's CommandComplete, e.g. "SELECT 120", and
+	// the number of rows the backend returned
+	CommandTag string
+	Rows       int64
+	// Set when the backend answered with an ErrorResponse
+	Error *QueryError `json:",omitempty"`
+	// From the client's Query or Execute message to the backend's
+	// CommandComplete or ReadyForQuery
+	StartTime time.Time
+	EndTime   time.Time
+	Duration  time.Duration
+}
+
+// Command returns the kind of statement, e.g. SELECT or INSERT, from the
+// command tag, or from the first keyword of the query when the backend
+// sent no tag
+func (q QueryExecuted) Command() string {
+	if command, _, _ := strings.Cut(q.CommandTag, " "); command != "" {
+		return command
+	}
+	return strings.ToUpper(firstKeyword(q.Query))
+}
+
+// firstKeyword returns the first word of a query, skipping whitespace and
+// comments
+func firstKeyword(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			_, query, _ = strings.Cut(query, "\n")
+		case strings.HasPrefix(query, "/*"):
+			_, query, _ = strings.Cut(query, "*/")
+		default:
+			end := strings.IndexFunc(query, func(r rune) bool {
+				return !unicode.IsLetter(r)
+			})
+			if end < 0 {
+				return query
+			}
+			return query[:end]
+		}
+	}
+}
+
+// QueryError holds the fields of the ErrorResponse a query failed with
+type QueryError struct {
+	Severity string
+	// SQLSTATE error code
+	Code     string
+	Message  string
+	Detail   string `json:",omitempty"`
+	Hint     string `json:",omitempty"`
+	Position int    `json:",omitempty"`
+}
+
+// Transaction is a transaction block and the queries that ran in it
+type Transaction struct {
+	ID              uint64
+	ConnectionID    uint64
+	Database        string
+	ApplicationName string
+	// commit, rollback, or open when the block never ended
+	Outcome   string
+	StartTime time.Time
+	EndTime   time.Time
+	Duration  time.Duration
+	Queries   []QueryExecuted
 }
 
+// Transaction outcomes
+const (
+	OutcomeCommit   = "commit"
+	OutcomeRollback = "rollback"
+	OutcomeOpen     = "open"
+)
+
+// What a full store does with a new query
+const (
+	// Evict the oldest query to make room
+	PolicyRing = "ring"
+	// Drop the new query
+	PolicyReject = "reject"
+)
+
+// QueryStore holds captured queries for every connection, so it is safe
+// for concurrent use. A capacity above 0 bounds the number of queries held;
+// queries evicted or rejected once it is reached are counted as dropped.
+// With a backend, stored queries are also persisted and reloaded on start.
 type QueryStore struct {
+	mu       sync.Mutex
+	capacity int
+	policy   string
+	backend  Backend
+	// Ring buffer of queries starting at head. Without a capacity it only
+	// grows and head stays 0.
 	queryMap []QueryExecuted
+	head     int
+	dropped  uint64
+	lastID   uint64
+	// Capture windows by ID, and their IDs in the order they started
+	sessions     map[string]*Session
+	sessionOrder []string
+	// Channels of live subscribers, see Subscribe
+	subscribers map[chan QueryExecuted]struct{}
+	// Writes for the goroutine persisting to the backend, which wake
+	// signals. Queries past writeBuffer are kept in memory only and
+	// counted in unpersisted. Close sets closing and waits for persisted
+	// to be closed.
+	writes      []backendWrite
+	unpersisted uint64
+	wake        chan struct{}
+	closing     bool
+	persisted   chan struct{}
 }
 
-func MakeQueryStore() *QueryStore {
-	return &QueryStore{}
+// MakeQueryStore creates a store, loading the queries already persisted in
+// backend, which may be nil to keep queries in memory only
+func MakeQueryStore(capacity int, policy string, backend Backend) (*QueryStore, error) {
+	if policy != PolicyRing && policy != PolicyReject {
+		return nil, fmt.Errorf("unknown eviction policy %q, expected %s or %s", policy, PolicyRing, PolicyReject)
+	}
+	qs := &QueryStore{
+		capacity:    capacity,
+		policy:      policy,
+		backend:     backend,
+		sessions:    map[string]*Session{},
+		subscribers: map[chan QueryExecuted]struct{}{},
+	}
+	if backend != nil {
+		// Queries are added as they are read, so a ring only ever holds
+		// capacity of them however many were persisted
+		err := backend.Load(func(q QueryExecuted) error {
+			// Keep persisted IDs so cursors stay valid across restarts
+			if q.ID == 0 {
+				q.ID = qs.lastID + 1
+			}
+			if q.ID > qs.lastID {
+				qs.lastID = q.ID
+			}
+			if q.Fingerprint == "" {
+				q.Fingerprint = sqlnorm.Fingerprint(q.Query)
+			}
+			qs.add(q)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load persisted queries: %v", err)
+		}
+		// Those left out by the policy were captured by an earlier run,
+		// which counted its own drops
+		qs.dropped = 0
+		qs.wake = make(chan struct{}, 1)
+		qs.persisted = make(chan struct{})
+		go qs.persist()
+	}
+	return qs, nil
 }
 
+// AddQuery stores a query and queues it to be persisted if the store
+// accepted it. Capture doesn't wait for the disk: failures to persist are
+// logged, and queries past a full queue counted, with the query kept in
+// memory either way.
 func (qs *QueryStore) AddQuery(q QueryExecuted) {
-	qs.queryMap = append(qs.queryMap, q)
+	q.Fingerprint = sqlnorm.Fingerprint(q.Query)
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	qs.lastID++
+	q.ID = qs.lastID
+	if !qs.add(q) {
+		return
+	}
+	for ch := range qs.subscribers {
+		// A slow subscriber misses queries rather than stalling capture
+		select {
+		case ch <- q:
+		default:
+		}
+	}
+	if qs.backend == nil {
+		return
+	}
+	// Queued under the lock so writes keep the order of the store, but
+	// never waiting for the backend, which would stall capture and every
+	// reader of the store
+	if len(qs.writes) < writeBuffer {
+		qs.writes = append(qs.writes, backendWrite{query: q})
+	} else {
+		qs.unpersisted++
+		metrics.UnpersistedQueriesTotal.Inc()
+	}
+	qs.wakePersist()
 }
 
-func (qs QueryStore) ListQueries() []QueryExecuted {
-	return qs.queryMap
+// Subscribe returns a channel receiving every query stored from now on,
+// and a function that ends the subscription. Queries are skipped while
+// the channel's buffer is full.
+func (qs *QueryStore) Subscribe(buffer int) (<-chan QueryExecuted, func()) {
+	ch := make(chan QueryExecuted, buffer)
+	qs.mu.Lock()
+	qs.subscribers[ch] = struct{}{}
+	qs.mu.Unlock()
+
+	return ch, func() {
+		qs.mu.Lock()
+		delete(qs.subscribers, ch)
+		qs.mu.Unlock()
+	}
+}
+
+// add applies the eviction policy and reports whether q was stored
+func (qs *QueryStore) add(q QueryExecuted) bool {
+	if qs.capacity <= 0 || len(qs.queryMap) < qs.capacity {
+		qs.queryMap = append(qs.queryMap, q)
+		return true
+	}
+	qs.dropped++
+	if qs.policy == PolicyRing {
+		qs.queryMap[qs.head] = q
+		qs.head = (qs.head + 1) % len(qs.queryMap)
+		return true
+	}
+	return false
+}
+
+// Close persists the queued queries and closes the backend. No queries
+// may be added after it.
+func (qs *QueryStore) Close() error {
+	if qs.backend == nil {
+		return nil
+	}
+	qs.mu.Lock()
+	qs.closing = true
+	qs.wakePersist()
+	qs.mu.Unlock()
+	<-qs.persisted
+	return qs.backend.Close()
+}
+
+// ListQueries returns a copy of the stored queries, oldest first
+func (qs *QueryStore) ListQueries() []QueryExecuted {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.list()
+}
+
+// PageQueries returns, oldest first, up to limit of the stored queries
+// after the one with ID cursor for which match is true, and the cursor of
+// the next page, 0 when this is the last one. A limit of 0 returns every
+// match. IDs grow in store order, so the cursor is found by binary search
+// and only the page is copied.
+func (qs *QueryStore) PageQueries(cursor uint64, limit int, match func(QueryExecuted) bool) ([]QueryExecuted, uint64) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	n := len(qs.queryMap)
+	at := func(i int) QueryExecuted {
+		return qs.queryMap[(qs.head+i)%n]
+	}
+	page := []QueryExecuted{}
+	start := sort.Search(n, func(i int) bool { return at(i).ID > cursor })
+	for i := start; i < n; i++ {
+		q := at(i)
+		if !match(q) {
+			continue
+		}
+		if limit > 0 && len(page) == limit {
+			return page, page[len(page)-1].ID
+		}
+		page = append(page, q)
+	}
+	return page, 0
+}
+
+func (qs *QueryStore) list() []QueryExecuted {
+	queries := make([]QueryExecuted, 0, len(qs.queryMap))
+	queries = append(queries, qs.queryMap[qs.head:]...)
+	return append(queries, qs.queryMap[:qs.head]...)
+}
+
+// ClearQueries empties the store, including its backend, and returns the
+// queries it held. Queries added concurrently land either in the returned
+// snapshot or in the emptied store, never in neither.
+func (qs *QueryStore) ClearQueries() ([]QueryExecuted, error) {
+	qs.mu.Lock()
+	queries := qs.list()
+	qs.queryMap = nil
+	qs.head = 0
+	qs.dropped = 0
+	if qs.backend == nil {
+		qs.mu.Unlock()
+		return queries, nil
+	}
+	// Queries queued before the reset are persisted first, and then
+	// removed with the rest. Unlike them it is never left out.
+	reset := make(chan error, 1)
+	qs.writes = append(qs.writes, backendWrite{reset: reset})
+	qs.wakePersist()
+	qs.mu.Unlock()
+	if err := <-reset; err != nil {
+		return queries, fmt.Errorf("failed to reset backend: %v", err)
+	}
+	return queries, nil
+}
+
+// Dropped returns the number of queries evicted or rejected because the
+// store was full
+func (qs *QueryStore) Dropped() uint64 {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.dropped
+}
+
+// ListTransactions groups the captured queries that ran in transaction
+// blocks by transaction, in the order the transactions started
+func (qs *QueryStore) ListTransactions() []Transaction {
+	return GroupTransactions(qs.ListQueries())
+}
+
+// GroupTransactions groups queries by TransactionID. A block is over once
+// the backend reports it idle after its last query, and rolled back when
+// that query is tagged ROLLBACK, as Postgres tags the COMMIT of a failed
+// transaction. ROLLBACK TO SAVEPOINT is tagged ROLLBACK too but leaves the
+// block open.
+func GroupTransactions(queries []QueryExecuted) []Transaction {
+	transactions := []Transaction{}
+	index := map[uint64]int{}
+	for _, q := range queries {
+		if q.TransactionID == 0 {
+			continue
+		}
+		i, ok := index[q.TransactionID]
+		if !ok {
+			i = len(transactions)
+			index[q.TransactionID] = i
+			transactions = append(transactions, Transaction{
+				ID:              q.TransactionID,
+				ConnectionID:    q.ConnectionID,
+				Database:        q.Database,
+				ApplicationName: q.ApplicationName,
+				StartTime:       q.StartTime,
+			})
+		}
+		t := &transactions[i]
+		t.Queries = append(t.Queries, q)
+		t.EndTime = q.EndTime
+	}
+
+	for i := range transactions {
+		t := &transactions[i]
+		t.Duration = t.EndTime.Sub(t.StartTime)
+		last := t.Queries[len(t.Queries)-1]
+		switch {
+		// Captures without the status go by the tag alone
+		case last.TransactionStatus == "" && last.CommandTag == "COMMIT":
+			t.Outcome = OutcomeCommit
+		case last.TransactionStatus == "" && last.CommandTag == "ROLLBACK":
+			t.Outcome = OutcomeRollback
+		case last.TransactionStatus != "I":
+			t.Outcome = OutcomeOpen
+		case last.CommandTag == "ROLLBACK":
+			t.Outcome = OutcomeRollback
+		default:
+			t.Outcome = OutcomeCommit
+		}
+	}
+	return transactions
 }
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupTransactionsOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []QueryExecuted
+		want    string
+	}{
+		{"commit", []QueryExecuted{
+			{CommandTag: "BEGIN", TransactionStatus: "T"},
+			{CommandTag: "COMMIT", TransactionStatus: "I"},
+		}, OutcomeCommit},
+		{"failed commit", []QueryExecuted{
+			{CommandTag: "BEGIN", TransactionStatus: "T"},
+			{Error: &QueryError{Code: "23505"}, TransactionStatus: "E"},
+			{CommandTag: "ROLLBACK", TransactionStatus: "I"},
+		}, OutcomeRollback},
+		{"rollback to savepoint", []QueryExecuted{
+			{CommandTag: "BEGIN", TransactionStatus: "T"},
+			{CommandTag: "ROLLBACK", TransactionStatus: "T"},
+		}, OutcomeOpen},
+		{"failed", []QueryExecuted{
+			{CommandTag: "BEGIN", TransactionStatus: "T"},
+			{Error: &QueryError{Code: "23505"}, TransactionStatus: "E"},
+		}, OutcomeOpen},
+		// Captured before the transaction status was recorded
+		{"commit without status", []QueryExecuted{{CommandTag: "BEGIN"}, {CommandTag: "COMMIT"}}, OutcomeCommit},
+		{"rollback without status", []QueryExecuted{{CommandTag: "BEGIN"}, {CommandTag: "ROLLBACK"}}, OutcomeRollback},
+		{"open without status", []QueryExecuted{{CommandTag: "BEGIN"}, {CommandTag: "UPDATE 1"}}, OutcomeOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.queries {
+				tt.queries[i].TransactionID = 1
+			}
+			transactions := GroupTransactions(tt.queries)
+			if len(transactions) != 1 {
+				t.Fatalf("got %d transactions, want 1", len(transactions))
+			}
+			if got := transactions[0].Outcome; got != tt.want {
+				t.Errorf("outcome is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadIntoRing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.ndjson")
+	b, err := OpenNDJSONBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append([]QueryExecuted{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	b, err = OpenNDJSONBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := MakeQueryStore(3, PolicyRing, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qs.Close()
+	got := qs.ListQueries()
+	if len(got) != 3 || got[0].ID != 3 || got[2].ID != 5 {
+		t.Fatalf("got %+v, want the last 3 persisted queries", got)
+	}
+	// Reloading doesn't drop anything captured by this run
+	if d := qs.Dropped(); d != 0 {
+		t.Errorf("%d queries dropped after loading, want 0", d)
+	}
+	qs.AddQuery(QueryExecuted{Query: "SELECT 1"})
+	if d := qs.Dropped(); d != 1 {
+		t.Errorf("%d queries dropped after a query wrapped the ring, want 1", d)
+	}
+	if got := qs.ListQueries(); got[2].ID != 6 {
+		t.Errorf("new query has ID %d, want 6", got[2].ID)
+	}
+}
+
+// stalledBackend blocks every Append until release is closed
+type stalledBackend struct {
+	release  chan struct{}
+	appended atomic.Int64
+}
+
+func (b *stalledBackend) Append(queries []QueryExecuted) error {
+	<-b.release
+	b.appended.Add(int64(len(queries)))
+	return nil
+}
+
+func (b *stalledBackend) Load(fn func(QueryExecuted) error) error { return nil }
+func (b *stalledBackend) Reset() error                            { return nil }
+func (b *stalledBackend) Close() error                            { return nil }
+
+func TestAddQueryDoesNotWaitForBackend(t *testing.T) {
+	b := &stalledBackend{release: make(chan struct{})}
+	qs, err := MakeQueryStore(0, PolicyRing, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*writeBuffer; i++ {
+			qs.AddQuery(QueryExecuted{Query: "SELECT 1"})
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(10 * time.Second):
+		t.Fatal("AddQuery waited for the backend")
+	}
+	if got := len(qs.ListQueries()); got != 2*writeBuffer {
+		t.Errorf("store holds %d queries, want %d", got, 2*writeBuffer)
+	}
+
+	close(b.release)
+	if err := qs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The queue holds writeBuffer queries, and the writer may have taken
+	// some before it stalled
+	if n := b.appended.Load(); n < writeBuffer || n >= 2*writeBuffer {
+		t.Errorf("%d queries persisted, want the %d queued and those the writer took", n, writeBuffer)
+	}
+}
+
+func TestPageQueries(t *testing.T) {
+	// IDs 4 to 8 are left, wrapped around the ring
+	qs, err := MakeQueryStore(5, PolicyRing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		qs.AddQuery(QueryExecuted{Query: "SELECT 1"})
+	}
+	all := func(QueryExecuted) bool { return true }
+	even := func(q QueryExecuted) bool { return q.ID%2 == 0 }
+
+	tests := []struct {
+		name   string
+		cursor uint64
+		limit  int
+		match  func(QueryExecuted) bool
+		want   []uint64
+		next   uint64
+	}{
+		{"first page", 0, 2, all, []uint64{4, 5}, 5},
+		{"middle page", 5, 2, all, []uint64{6, 7}, 7},
+		{"last page", 7, 2, all, []uint64{8}, 0},
+		{"exact last page", 6, 2, all, []uint64{7, 8}, 0},
+		{"evicted cursor", 2, 2, all, []uint64{4, 5}, 5},
+		{"past the end", 8, 2, all, nil, 0},
+		{"no limit", 4, 0, all, []uint64{5, 6, 7, 8}, 0},
+		{"filtered", 0, 1, even, []uint64{4}, 4},
+		{"filtered middle page", 4, 1, even, []uint64{6}, 6},
+		{"filtered past the last match", 6, 1, even, []uint64{8}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, next := qs.PageQueries(tt.cursor, tt.limit, tt.match)
+			var got []uint64
+			for _, q := range page {
+				got = append(got, q.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) || next != tt.next {
+				t.Errorf("PageQueries(%d, %d) = %v with next %d, want %v with next %d", tt.cursor, tt.limit, got, next, tt.want, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Modes for the connection to the backend, named after libpq's sslmode
+const (
+	sslModeDisable    = "disable"
+	sslModePrefer     = "prefer"
+	sslModeRequire    = "require"
+	sslModeVerifyFull = "verify-full"
+)
+
+// loadClientTLSConfig loads the certificate the proxy presents to clients
+// that send an SSLRequest. Without one the proxy declines TLS.
+func loadClientTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// loadBackendTLSConfig builds the TLS config for connecting to the backend
+// in the given sslmode. It returns nil when TLS is disabled.
+func loadBackendTLSConfig(sslMode, rootCertFile, serverName string) (*tls.Config, error) {
+	switch sslMode {
+	case sslModeDisable:
+		return nil, nil
+	case sslModePrefer, sslModeRequire:
+		// Like libpq, these modes encrypt without verifying the server
+		return &tls.Config{
+			InsecureSkipVerify: true,
+		}, nil
+	case sslModeVerifyFull:
+		config := &tls.Config{
+			ServerName: serverName,
+		}
+		if rootCertFile != "" {
+			pem, err := os.ReadFile(rootCertFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read backend root certificate: %v", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", rootCertFile)
+			}
+		}
+		return config, nil
+	default:
+		return nil, fmt.Errorf("unknown BACKEND_SSLMODE %q, expected disable, prefer, require or verify-full", sslMode)
+	}
+}